@@ -0,0 +1,45 @@
+// Command reconcile compares Stripe with the database and repairs
+// memberships, purchases and customer links that missed a webhook.
+//
+//	go run ./cmd/reconcile -dry-run -since 720h
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report discrepancies without fixing them")
+	since := flag.Duration("since", 7*24*time.Hour, "how far back to check checkout sessions")
+	flag.Parse()
+
+	if err := godotenv.Load(".env"); err != nil {
+		panic(err)
+	}
+	database.InitDB()
+	database.InitRedis()
+	database.LoadMaterials()
+	service.InitStripe()
+
+	report, err := service.Reconcile(service.ReconcileOptions{
+		DryRun: *dryRun,
+		Since:  time.Now().Add(-*since),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reconciliation failed:", err)
+		os.Exit(1)
+	}
+
+	for _, d := range report.Discrepancies {
+		fmt.Println(d)
+	}
+	fmt.Printf("%d discrepancies, %d fixed\n", len(report.Discrepancies), report.FixedCount())
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+)
+
+func AssignAccessHandlers(app *fiber.App) {
+	app.Get("/access/:resource/:resourceId/user/:userId", handleAccess)
+}
+
+func handleAccess(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	resourceId, err := uuid.Parse(c.Params("resourceId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	var decision entitlement.Decision
+	switch c.Params("resource") {
+	case "course":
+		decision, err = entitlement.ForCourseUnlocked(user, resourceId)
+	case "chapter":
+		decision, err = entitlement.ForChapter(user, resourceId)
+	case "content":
+		decision, err = entitlement.ForContent(user, resourceId)
+	default:
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if errors.Is(err, entitlement.ErrNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.JSON(decision)
+}
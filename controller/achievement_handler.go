@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignAchievementHandlers(app *fiber.App) {
+	app.Get("/achievements/user/:userId", handleUserAchievements)
+}
+
+func handleUserAchievements(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	summary, err := service.GetAchievementSummary(user)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(summary)
+}
@@ -0,0 +1,302 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+// Admin routes are only served when ADMIN_API_KEY is configured.
+func AssignAdminHandlers(app *fiber.App) {
+	admin := app.Group("/admin", requireAdminKey)
+	admin.Post("/access/course/:courseId/user/:userId/grant", handleAdminGrantCourseAccess)
+	admin.Post("/access/course/:courseId/user/:userId/revoke", handleAdminRevokeCourseAccess)
+	admin.Post("/gift/:code/revoke", handleAdminRevokeGiftCode)
+	admin.Post("/promotion-rule", handleAdminSavePromotionRule)
+	admin.Post("/partner", handleAdminCreatePartner)
+	admin.Post("/partner/:partnerId/referral-code", handleAdminCreatePartnerReferralCode)
+	admin.Get("/partner/:partnerId/report", handleAdminPartnerReport)
+	admin.Post("/progress/:resource/:resourceId/user/:userId/reset", handleAdminResetProgress)
+	admin.Post("/progress/content/:contentId/user/:userId/uncomplete", handleAdminUncompleteContent)
+}
+
+func requireAdminKey(c *fiber.Ctx) error {
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	if adminKey == "" {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Get("X-Admin-Key")), []byte(adminKey)) != 1 {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	return c.Next()
+}
+
+type AdminGrantRequest struct {
+	Note      string     `json:"note"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type AdminPromotionRuleRequest struct {
+	Code                       string     `json:"code"`
+	CourseIds                  []string   `json:"courseIds"`
+	UserIds                    []string   `json:"userIds"`
+	FirstPurchaseOnly          bool       `json:"firstPurchaseOnly"`
+	ReplacesMembershipDiscount bool       `json:"replacesMembershipDiscount"`
+	ExpiresAt                  *time.Time `json:"expiresAt"`
+}
+
+// AdminPartnerRequest creates a partner. UserId is the partner's Clerk user
+// ID and is optional.
+type AdminPartnerRequest struct {
+	Name              string  `json:"name"`
+	UserId            string  `json:"userId"`
+	CommissionPercent float64 `json:"commissionPercent"`
+}
+
+// AdminProgressResetRequest carries a note kept with the archived progress,
+// e.g. the support ticket the reset was made for.
+type AdminProgressResetRequest struct {
+	Note string `json:"note"`
+}
+
+type AdminReferralCodeRequest struct {
+	Code              string   `json:"code"`
+	CommissionPercent *float64 `json:"commissionPercent"`
+}
+
+func handleAdminGrantCourseAccess(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var request AdminGrantRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	grant, err := service.GrantCourseAccess(user.Id.Bytes, courseId, models.AccessGrantSourceAdmin, request.Note, request.ExpiresAt)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.JSON(fiber.Map{
+		"id":        grant.Id,
+		"expiresAt": grant.ExpiresAt,
+	})
+}
+
+func handleAdminRevokeCourseAccess(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if err := service.RevokeCourseAccess(user.Id.Bytes, courseId, models.AccessGrantSourceAdmin); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleAdminRevokeGiftCode(c *fiber.Ctx) error {
+	code := utils.CopyString(c.Params("code"))
+
+	if err := service.RevokeGiftCode(code, nil, true); err != nil {
+		return c.SendStatus(giftErrorStatus(err))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// handleAdminSavePromotionRule creates or replaces the local rule for a
+// promotion code. User IDs are Clerk user IDs.
+func handleAdminSavePromotionRule(c *fiber.Ctx) error {
+	var request AdminPromotionRuleRequest
+	if err := c.BodyParser(&request); err != nil || request.Code == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	rule := models.PromotionRule{
+		Code:                       request.Code,
+		FirstPurchaseOnly:          request.FirstPurchaseOnly,
+		ReplacesMembershipDiscount: request.ReplacesMembershipDiscount,
+		ExpiresAt:                  request.ExpiresAt,
+	}
+	rule.CourseIds.Set([]string{})
+	rule.UserIds.Set([]string{})
+
+	for _, courseIdString := range request.CourseIds {
+		if _, err := uuid.Parse(courseIdString); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if err := rule.CourseIds.Append(courseIdString); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+	for _, clerkUserId := range request.UserIds {
+		user, err := entitlement.LoadUser(clerkUserId)
+		if err != nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		userId, _ := uuid.FromBytes(user.Id.Bytes[:])
+		if err := rule.UserIds.Append(userId.String()); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+
+	if err := service.SavePromotionRule(&rule); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleAdminCreatePartner(c *fiber.Ctx) error {
+	var request AdminPartnerRequest
+	if err := c.BodyParser(&request); err != nil || request.Name == "" || request.CommissionPercent < 0 || request.CommissionPercent > 100 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	partner, err := service.CreatePartner(request.Name, request.UserId, request.CommissionPercent)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	partnerId, _ := uuid.FromBytes(partner.Id.Bytes[:])
+	return c.JSON(fiber.Map{
+		"id": partnerId.String(),
+	})
+}
+
+func handleAdminCreatePartnerReferralCode(c *fiber.Ctx) error {
+	partnerId, err := uuid.Parse(c.Params("partnerId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var request AdminReferralCodeRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+	}
+	if request.CommissionPercent != nil && (*request.CommissionPercent < 0 || *request.CommissionPercent > 100) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	referralCode, err := service.CreatePartnerReferralCode(partnerId, request.Code, request.CommissionPercent)
+	if err != nil {
+		return c.SendStatus(referralErrorStatus(err))
+	}
+	return c.JSON(fiber.Map{
+		"code": referralCode.Code,
+	})
+}
+
+func handleAdminPartnerReport(c *fiber.Ctx) error {
+	partnerId, err := uuid.Parse(c.Params("partnerId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	report, err := service.GetPartnerReport(partnerId)
+	if err != nil {
+		return c.SendStatus(referralErrorStatus(err))
+	}
+	return c.JSON(report)
+}
+
+func adminProgressResetNote(c *fiber.Ctx) (string, bool) {
+	var request AdminProgressResetRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return "", false
+		}
+	}
+	return request.Note, true
+}
+
+// handleAdminResetProgress resets a user's progress on a content, chapter
+// or course, as the :resource parameter says.
+func handleAdminResetProgress(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	resourceId, err := uuid.Parse(c.Params("resourceId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	note, ok := adminProgressResetNote(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	reset, err := service.ResetProgress(user.Id.Bytes, c.Params("resource"), resourceId, models.ProgressResetByAdmin, note)
+	switch {
+	case errors.Is(err, service.ErrInvalidResource):
+		return c.SendStatus(fiber.StatusBadRequest)
+	case errors.Is(err, service.ErrMaterialNotFound):
+		return c.SendStatus(fiber.StatusNotFound)
+	case err != nil:
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"reset": reset,
+	})
+}
+
+func handleAdminUncompleteContent(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	contentId, err := uuid.Parse(c.Params("contentId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	note, ok := adminProgressResetNote(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	err = service.UncompleteContent(user.Id.Bytes, contentId, models.ProgressResetByAdmin, note)
+	if errors.Is(err, service.ErrContentNotCompleted) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
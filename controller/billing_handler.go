@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignBillingHandlers(app *fiber.App) {
+	app.Post("/billing/user/:userId/portal", handleCreateBillingPortalLink)
+	app.Get("/billing/user/:userId/invoices", handleUserInvoices)
+	app.Get("/billing/user/:userId/payments", handleUserPayments)
+}
+
+func handleCreateBillingPortalLink(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	url, err := service.CreateBillingPortalLink(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"url": url,
+	})
+}
+
+func handleUserInvoices(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	invoices, err := service.ListInvoices(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(invoices)
+}
+
+func handleUserPayments(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	payments, err := service.ListPayments(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(payments)
+}
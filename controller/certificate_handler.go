@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignCertificateHandlers(app *fiber.App) {
+	app.Get("/certificate/user/:userId", handleUserCertificates)
+	app.Post("/certificate/course/:courseId/user/:userId", handleIssueCertificate)
+
+	// Public, for whoever the student shows their certificate to
+	app.Get("/certificate/:certificateId/verify", handleVerifyCertificate)
+	app.Get("/certificate/:certificateId/pdf", handleCertificatePDF)
+}
+
+func handleUserCertificates(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	certificates, err := service.GetUserCertificates(user)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(certificates)
+}
+
+func handleIssueCertificate(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	certificate, err := service.IssueCertificate(user, courseId)
+	switch {
+	case errors.Is(err, service.ErrCourseNotFound):
+		return c.SendStatus(fiber.StatusNotFound)
+	case errors.Is(err, service.ErrCourseNotCompleted):
+		return c.SendStatus(fiber.StatusConflict)
+	case errors.Is(err, service.ErrCertificatePending):
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"pending": true,
+		})
+	case err != nil:
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(certificate)
+}
+
+func handleVerifyCertificate(c *fiber.Ctx) error {
+	certificateId, err := uuid.Parse(c.Params("certificateId"))
+	if err != nil {
+		return c.JSON(fiber.Map{
+			"verified": false,
+		})
+	}
+
+	certificate, err := service.GetCertificate(certificateId)
+	if errors.Is(err, service.ErrCertificateNotFound) {
+		return c.JSON(fiber.Map{
+			"verified": false,
+		})
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.JSON(fiber.Map{
+		"verified":      true,
+		"certificateId": certificateId.String(),
+		"recipientName": certificate.RecipientName,
+		"courseTitle":   certificate.CourseTitle,
+		"issuedAt":      certificate.IssuedAt,
+	})
+}
+
+func handleCertificatePDF(c *fiber.Ctx) error {
+	certificateId, err := uuid.Parse(c.Params("certificateId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	certificate, err := service.GetCertificate(certificateId)
+	if errors.Is(err, service.ErrCertificateNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	pdf, err := service.RenderCertificatePDF(certificate)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, `inline; filename="certificate-`+certificateId.String()+`.pdf"`)
+	return c.Send(pdf)
+}
@@ -1,69 +1,228 @@
 package controller
 
 import (
+	"errors"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 
 	"github.com/google/uuid"
 
 	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
 	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/service"
 )
 
 func AssignCompletionHandlers(app *fiber.App) {
+	app.Post("/completion/content/:contentId/user/:userId/start", handleStartContent)
 	app.Post("/completion/content/:contentId/user/:userId/complete", handleCompleteContent)
+	app.Post("/completion/content/:contentId/user/:userId/attempt", handleContentAttempt)
+	app.Post("/completion/content/:contentId/user/:userId/heartbeat", handleContentHeartbeat)
+	app.Post("/completion/content/:contentId/user/:userId/uncomplete", handleUncompleteContent)
+	app.Post("/completion/chapter/:chapterId/user/:userId/reset", handleResetChapter)
+	app.Post("/completion/course/:courseId/user/:userId/reset", handleResetCourse)
 	app.Get("/completion/course/:courseId/user/:userId/verify", handleVerifyCourseCompletion)
 	app.Get("/completion/chapter/:chapterId/user/:userId/verify", handleVerifyChapterCompletion)
 	app.Get("/completion/content/:contentId/user/:userId/verify", handleVerifyContentCompletion)
 }
 
-func handleCompleteContent(c *fiber.Ctx) error {
+type ContentAttemptRequest struct {
+	Score     *float64 `json:"score"`
+	Completed bool     `json:"completed"`
+}
+
+// loadContentUser loads the user and checks they may open the content. The
+// returned status is only meaningful when the user is nil, and the decision
+// only when the status is forbidden.
+func loadContentUser(c *fiber.Ctx) (*models.AppUser, uuid.UUID, int, entitlement.Decision) {
 	clerkUserId := c.Params("userId")
 
-	contentIdString := c.Params("contentId")
-	contentId, err := uuid.Parse(contentIdString)
+	contentId, err := uuid.Parse(c.Params("contentId"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusOK)
+		return nil, uuid.Nil, fiber.StatusBadRequest, entitlement.Decision{}
 	}
 
-	var user models.AppUser
-	if err := database.DB.Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
-		return c.SendStatus(fiber.StatusOK)
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return nil, uuid.Nil, fiber.StatusNotFound, entitlement.Decision{}
 	}
 
-	// Find the content within the materials
-	var foundContent *models.Content
-	for _, course := range database.Materials {
-		for _, chapter := range course.Chapters {
-			for _, content := range chapter.Contents {
-				if content.Id.Bytes == contentId {
-					foundContent = &content
-					break
-				}
-			}
+	decision, err := entitlement.ForContent(user, contentId)
+	if err != nil {
+		return nil, uuid.Nil, fiber.StatusNotFound, entitlement.Decision{}
+	}
+	if !decision.Allowed {
+		return nil, uuid.Nil, fiber.StatusForbidden, decision
+	}
+	return user, contentId, fiber.StatusOK, decision
+}
+
+// sendContentDenied tells the client why content is refused, e.g. which
+// chapter must be completed to unlock it.
+func sendContentDenied(c *fiber.Ctx, status int, decision entitlement.Decision) error {
+	if status == fiber.StatusForbidden {
+		return c.Status(status).JSON(decision)
+	}
+	return c.SendStatus(status)
+}
+
+func handleStartContent(c *fiber.Ctx) error {
+	user, contentId, status, decision := loadContentUser(c)
+	if user == nil {
+		return sendContentDenied(c, status, decision)
+	}
+
+	if err := service.StartContent(user.Id.Bytes, contentId); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleCompleteContent(c *fiber.Ctx) error {
+	user, contentId, status, decision := loadContentUser(c)
+	if user == nil {
+		if status == fiber.StatusForbidden {
+			return sendContentDenied(c, status, decision)
 		}
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	if sent, err := sendMinimumTimeNotReached(c, user, contentId); sent {
+		return err
 	}
 
-	if foundContent == nil {
+	if err := service.CompleteContent(user.Id.Bytes, contentId); err != nil {
 		return c.SendStatus(fiber.StatusOK)
 	}
 
-	// Check if the content is already completed
-	for _, completedContentId := range user.CompletedContentId.Elements {
-		if completedContentId.Bytes == contentId {
-			return c.SendStatus(fiber.StatusOK)
+	// Rewards are idempotent, so a retried completion pays them if this fails
+	achievements, _ := service.RewardProgress(user.Id.Bytes, contentId)
+	return c.JSON(fiber.Map{
+		"achievements": achievements,
+	})
+}
+
+// sendMinimumTimeNotReached responds with 409 if the user has not spent the
+// content's minimum time on it yet, and reports whether it responded.
+func sendMinimumTimeNotReached(c *fiber.Ctx, user *models.AppUser, contentId uuid.UUID) (bool, error) {
+	_, _, contentPtr := database.GetCourseAndChapterAndContent(contentId)
+	if contentPtr == nil {
+		return false, nil
+	}
+	timeSpent, err := service.CheckMinimumTime(user.Id.Bytes, contentPtr)
+	if errors.Is(err, service.ErrMinimumTimeNotReached) {
+		return true, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"timeSpentSeconds": timeSpent,
+			"minimumSeconds":   contentPtr.MinimumSeconds,
+		})
+	}
+	if err != nil {
+		return true, c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return false, nil
+}
+
+func handleContentAttempt(c *fiber.Ctx) error {
+	user, contentId, status, decision := loadContentUser(c)
+	if user == nil {
+		return sendContentDenied(c, status, decision)
+	}
+
+	var request ContentAttemptRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if request.Completed {
+		if sent, err := sendMinimumTimeNotReached(c, user, contentId); sent {
+			return err
 		}
 	}
 
-	// Mark the content as completed
-	user.CompletedContentId.Append(contentIdString)
+	progress, err := service.RecordContentAttempt(user.Id.Bytes, contentId, request.Score, request.Completed)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	achievements, _ := service.RewardProgress(user.Id.Bytes, contentId)
+	return c.JSON(fiber.Map{
+		"status":       progress.Status,
+		"attempts":     progress.Attempts,
+		"score":        progress.Score,
+		"achievements": achievements,
+	})
+}
 
-	if err := database.DB.Save(&user).Error; err != nil {
-		return c.SendStatus(fiber.StatusOK)
+func handleContentHeartbeat(c *fiber.Ctx) error {
+	user, contentId, status, decision := loadContentUser(c)
+	if user == nil {
+		return sendContentDenied(c, status, decision)
 	}
 
+	credited, err := service.RecordHeartbeat(user.Id.Bytes, contentId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"creditedSeconds": credited,
+	})
+}
+
+func handleUncompleteContent(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	contentId, err := uuid.Parse(c.Params("contentId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	err = service.UncompleteContent(user.Id.Bytes, contentId, models.ProgressResetByUser, "")
+	if errors.Is(err, service.ErrContentNotCompleted) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
 	return c.SendStatus(fiber.StatusOK)
 }
 
+func handleResetChapter(c *fiber.Ctx) error {
+	return resetProgress(c, service.ResetResourceChapter, c.Params("chapterId"))
+}
+
+func handleResetCourse(c *fiber.Ctx) error {
+	return resetProgress(c, service.ResetResourceCourse, c.Params("courseId"))
+}
+
+func resetProgress(c *fiber.Ctx, resource string, resourceIdString string) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	resourceId, err := uuid.Parse(resourceIdString)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	reset, err := service.ResetProgress(user.Id.Bytes, resource, resourceId, models.ProgressResetByUser, "")
+	if errors.Is(err, service.ErrMaterialNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"reset": reset,
+	})
+}
+
 func handleVerifyCourseCompletion(c *fiber.Ctx) error {
 	clerkUserId := c.Params("userId")
 
@@ -90,23 +249,20 @@ func handleVerifyCourseCompletion(c *fiber.Ctx) error {
 		})
 	}
 
+	completed, err := service.GetCompletedContentIds(user.Id.Bytes)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
 	// Check if all chapters in the course are completed
 	for _, chapter := range coursePtr.Chapters {
 		for _, content := range chapter.Contents {
-			found := false
-			for _, completedContentId := range user.CompletedContentId.Elements {
-				if content.Id.Bytes == completedContentId.Bytes {
-					found = true
-					break
-				}
-			}
-			if !found {
+			if !completed[content.Id.Bytes] {
 				return c.JSON(fiber.Map{
 					"verified": false,
 				})
 			}
 		}
-
 	}
 
 	return c.JSON(fiber.Map{
@@ -132,34 +288,21 @@ func handleVerifyChapterCompletion(c *fiber.Ctx) error {
 		})
 	}
 
-	var chapterPtr *models.Chapter = nil
-
-outer:
-	for _, course := range database.Materials {
-		for _, chapter := range course.Chapters {
-			if chapter.Id.UUID.Bytes == chapterId {
-				chapterPtr = &chapter
-				break outer
-			}
-		}
-	}
-
+	_, chapterPtr := database.GetCourseAndChapter(chapterId)
 	if chapterPtr == nil {
 		return c.JSON(fiber.Map{
 			"verified": false,
 		})
 	}
 
+	completed, err := service.GetCompletedContentIds(user.Id.Bytes)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
 	// Check if all contents in the chapter are completed
 	for _, content := range chapterPtr.Contents {
-		found := false
-		for _, completedContentId := range user.CompletedContentId.Elements {
-			if completedContentId.Bytes == content.Id.Bytes {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if !completed[content.Id.Bytes] {
 			return c.JSON(fiber.Map{
 				"verified": false,
 			})
@@ -189,16 +332,12 @@ func handleVerifyContentCompletion(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if the content is completed
-	for _, completedContentId := range user.CompletedContentId.Elements {
-		if completedContentId.Bytes == contentId {
-			return c.JSON(fiber.Map{
-				"verified": true,
-			})
-		}
+	completed, err := service.IsContentCompleted(user.Id.Bytes, contentId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	return c.JSON(fiber.Map{
-		"verified": false,
+		"verified": completed,
 	})
 }
@@ -6,22 +6,27 @@ import (
 
 	"github.com/google/uuid"
 
-	"mehmetfd.dev/chessu-backend/database"
-	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/entitlement"
 	"mehmetfd.dev/chessu-backend/service"
 )
 
 func AssignCoursePurchaseHandlers(app *fiber.App) {
 	app.Get("/purchase/course/:courseId/user/:userId/verify", handleCoursePurchaseVerification)
 	app.Post("/purchase/course/:courseId/user/:userId/create-checkout-link", handleCreateCourseCheckoutLink)
+	app.Post("/purchase/bundle/:bundleId/user/:userId/create-checkout-link", handleCreateBundleCheckoutLink)
+	app.Post("/purchase/cart/user/:userId/create-checkout-link", handleCreateCartCheckoutLink)
 	app.Get("/price/course/:courseId/user/:userId", handleCoursePrice)
 }
 
+type CartCheckoutRequest struct {
+	CourseIds []string `json:"courseIds"`
+}
+
 func handleCoursePurchaseVerification(c *fiber.Ctx) error {
 	clerkUserId := c.Params("userId")
 
-	var user models.AppUser
-	if err := database.DB.Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
@@ -31,18 +36,17 @@ func handleCoursePurchaseVerification(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
-	for _, purchasedCourseId := range user.PurchasedCourseId.Elements {
-		if purchasedCourseId.Bytes == courseId {
-			return c.JSON(fiber.Map{
-				"verified": true,
-			})
-		}
+	decision, err := entitlement.ForCourse(user, courseId)
+	if err != nil {
+		return c.JSON(fiber.Map{
+			"verified": false,
+		})
 	}
 
 	return c.JSON(fiber.Map{
-		"verified": false,
+		"verified": decision.Allowed,
+		"reason":   decision.Reason,
 	})
-
 }
 
 func handleCreateCourseCheckoutLink(c *fiber.Ctx) error {
@@ -53,12 +57,69 @@ func handleCreateCourseCheckoutLink(c *fiber.Ctx) error {
 	if err != nil {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
-	url, err := service.GenerateCourseCheckoutLink(courseId, clerkUserId)
+	link, err := service.GenerateCourseCheckoutLink(courseId, clerkUserId, checkoutOptions(c))
+	return sendCheckoutLink(c, link, err)
+}
+
+func handleCreateBundleCheckoutLink(c *fiber.Ctx) error {
+	clerkUserId := c.Params("userId")
+
+	bundleIdString := utils.CopyString(c.Params("bundleId"))
+	bundleId, err := uuid.Parse(bundleIdString)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	link, err := service.GenerateBundleCheckoutLink(bundleId, clerkUserId, checkoutOptions(c))
+	return sendCheckoutLink(c, link, err)
+}
+
+func handleCreateCartCheckoutLink(c *fiber.Ctx) error {
+	clerkUserId := c.Params("userId")
+
+	var request CartCheckoutRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	courseIds := make([]uuid.UUID, len(request.CourseIds))
+	for i, courseIdString := range request.CourseIds {
+		courseId, err := uuid.Parse(courseIdString)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		courseIds[i] = courseId
+	}
+
+	link, err := service.GenerateCartCheckoutLink(courseIds, clerkUserId, checkoutOptions(c))
+	return sendCheckoutLink(c, link, err)
+}
+
+// checkoutOptions collects what decides the discount and price a buyer gets.
+// X-Country-Code is set by the proxy from the client's IP address.
+func checkoutOptions(c *fiber.Ctx) service.CheckoutOptions {
+	return service.CheckoutOptions{
+		PromotionCode:  utils.CopyString(c.Query("promotionCode")),
+		ReferralCode:   utils.CopyString(c.Query("referralCode")),
+		Currency:       utils.CopyString(c.Query("currency")),
+		Country:        utils.CopyString(c.Get("X-Country-Code")),
+		AcceptLanguage: utils.CopyString(c.Get(fiber.HeaderAcceptLanguage)),
+	}
+}
+
+// sendCheckoutLink reports rejected promotion codes to the caller so the
+// frontend can tell the user why their code was not accepted.
+func sendCheckoutLink(c *fiber.Ctx, link *service.CheckoutLink, err error) error {
+	if service.IsPromotionError(err) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	return c.JSON(fiber.Map{
-		"url": url,
+		"url":      link.URL,
+		"discount": link.Discount,
 	})
 }
 
@@ -70,11 +131,14 @@ func handleCoursePrice(c *fiber.Ctx) error {
 	if err != nil {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
-	price, err := service.GetUserCoursePrice(courseId, clerkUserId)
+	quote, err := service.GetUserCoursePrice(courseId, clerkUserId, checkoutOptions(c))
+	if service.IsPromotionError(err) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	return c.JSON(fiber.Map{
-		"price": price,
-	})
+	return c.JSON(quote)
 }
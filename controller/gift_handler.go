@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignGiftHandlers(app *fiber.App) {
+	app.Post("/gift/course/:courseId/user/:userId/create-checkout-link", handleCreateGiftCheckoutLink)
+	app.Post("/gift/:code/user/:userId/redeem", handleRedeemGiftCode)
+	app.Post("/gift/:code/user/:userId/revoke", handleRevokeGiftCode)
+	app.Get("/gift/user/:userId", handleUserGiftCodes)
+}
+
+type GiftCodeResponseItem struct {
+	Code      string     `json:"code"`
+	CourseId  string     `json:"courseId"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	Claimed   bool       `json:"claimed"`
+	ClaimedAt *time.Time `json:"claimedAt"`
+	Revoked   bool       `json:"revoked"`
+}
+
+func handleCreateGiftCheckoutLink(c *fiber.Ctx) error {
+	clerkUserId := c.Params("userId")
+
+	courseIdString := utils.CopyString(c.Params("courseId"))
+	courseId, err := uuid.Parse(courseIdString)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	link, err := service.GenerateGiftCheckoutLink(courseId, clerkUserId, checkoutOptions(c))
+	return sendCheckoutLink(c, link, err)
+}
+
+func handleRedeemGiftCode(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	code := utils.CopyString(c.Params("code"))
+
+	gift, err := service.RedeemGiftCode(code, clerkUserId)
+	if err != nil {
+		return c.SendStatus(giftErrorStatus(err))
+	}
+
+	courseId, _ := uuid.FromBytes(gift.CourseID.Bytes[:])
+	return c.JSON(fiber.Map{
+		"courseId": courseId.String(),
+	})
+}
+
+func handleRevokeGiftCode(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	code := utils.CopyString(c.Params("code"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	buyerId := uuid.UUID(user.Id.Bytes)
+	if err := service.RevokeGiftCode(code, &buyerId, false); err != nil {
+		return c.SendStatus(giftErrorStatus(err))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleUserGiftCodes(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	gifts, err := service.GetPurchasedGiftCodes(user.Id.Bytes)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	responses := make([]GiftCodeResponseItem, len(gifts))
+	for i, gift := range gifts {
+		courseId, _ := uuid.FromBytes(gift.CourseID.Bytes[:])
+		responses[i] = GiftCodeResponseItem{
+			Code:      gift.Code,
+			CourseId:  courseId.String(),
+			CreatedAt: gift.CreatedAt,
+			ExpiresAt: gift.ExpiresAt,
+			Claimed:   gift.RedeemedAt != nil,
+			ClaimedAt: gift.RedeemedAt,
+			Revoked:   gift.RevokedAt != nil,
+		}
+	}
+	return c.JSON(responses)
+}
+
+func giftErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrGiftCodeNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, service.ErrGiftCodeRedeemed), errors.Is(err, service.ErrAlreadyOwned):
+		return fiber.StatusConflict
+	case errors.Is(err, service.ErrGiftCodeExpired), errors.Is(err, service.ErrGiftCodeRevoked):
+		return fiber.StatusGone
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
@@ -4,7 +4,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
 	"mehmetfd.dev/chessu-backend/database"
-	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
 
 	"github.com/google/uuid"
 )
@@ -25,19 +26,30 @@ type UserHomepageCoursesResponse struct {
 func handleUserCourses(c *fiber.Ctx) error {
 	clerkUserId := utils.CopyString(c.Params("userId"))
 
-	var user models.AppUser
-	if err := database.DB.Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.JSON([]bool{})
+	}
+
+	accessibleCourseIds, err := entitlement.AccessibleCourseIds(user)
+	if err != nil {
+		return c.JSON([]bool{})
+	}
+
+	completed, err := service.GetCompletedContentIds(user.Id.Bytes)
+	if err != nil {
 		return c.JSON([]bool{})
 	}
 
-	// Mark the content as completed
 	ids := [][16]byte{}
-	for _, element := range user.PurchasedCourseId.Elements {
-		ids = append(ids, element.Bytes)
+	for _, courseId := range accessibleCourseIds {
+		ids = append(ids, courseId)
 	}
-	for _, element := range user.CompletedContentId.Elements {
-		coursePtr, _, _ := database.GetCourseAndChapterAndContent(element.Bytes)
-		ids = append(ids, coursePtr.Id.Bytes)
+	for contentId := range completed {
+		coursePtr, _, _ := database.GetCourseAndChapterAndContent(contentId)
+		if coursePtr != nil {
+			ids = append(ids, coursePtr.Id.Bytes)
+		}
 	}
 
 	ids = removeDuplicates(ids)
@@ -48,7 +60,7 @@ func handleUserCourses(c *fiber.Ctx) error {
 		courseIdStr, _ := uuid.FromBytes(courseId[:])
 		responses[i] = UserHomepageCoursesResponseItem{
 			CourseId:             courseIdStr.String(),
-			CompletionPercentage: calculateCompletionPercentage(courseId, user.Id.Bytes),
+			CompletionPercentage: calculateCompletionPercentage(courseId, completed),
 		}
 	}
 
@@ -78,31 +90,18 @@ func removeDuplicates(arr [][16]byte) [][16]byte {
 	return result
 }
 
-func calculateCompletionPercentage(courseId uuid.UUID, userId uuid.UUID) uint8 {
+func calculateCompletionPercentage(courseId uuid.UUID, completed map[uuid.UUID]bool) uint8 {
 	coursePtr := database.GetCourse(courseId)
 	if coursePtr == nil {
 		return 0
 	}
 
-	var user models.AppUser
-
-	if err := database.DB.Find(&user, userId).Error; err != nil {
-		return 0
-	}
-
 	completedContentIds := make([]uuid.UUID, 0)
 	notCompletedContentIds := make([]uuid.UUID, 0)
 
 	for _, chapter := range coursePtr.Chapters {
 		for _, content := range chapter.Contents {
-			found := false
-			for _, completedContentId := range user.CompletedContentId.Elements {
-				if completedContentId == content.Id.UUID {
-					found = true
-					break
-				}
-			}
-			if found {
+			if completed[content.Id.Bytes] {
 				completedContentIds = append(completedContentIds, content.Id.Bytes)
 			} else {
 				notCompletedContentIds = append(notCompletedContentIds, content.Id.Bytes)
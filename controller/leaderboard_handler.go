@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignLeaderboardHandlers(app *fiber.App) {
+	app.Get("/leaderboard/:metric/user/:userId", handleLeaderboard)
+	app.Post("/leaderboard/user/:userId/settings", handleLeaderboardSettings)
+}
+
+type LeaderboardSettingsRequest struct {
+	OptOut bool `json:"optOut"`
+}
+
+// handleLeaderboard takes period (weekly, monthly, all_time), scope
+// (global, course, organization), scopeId and limit from the query.
+func handleLeaderboard(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	board, err := service.GetLeaderboard(
+		user,
+		c.Params("metric"),
+		c.Query("period", service.PeriodWeekly),
+		c.Query("scope", service.ScopeGlobal),
+		c.Query("scopeId"),
+		c.QueryInt("limit"),
+	)
+	switch {
+	case errors.Is(err, service.ErrInvalidLeaderboard):
+		return c.SendStatus(fiber.StatusBadRequest)
+	case errors.Is(err, service.ErrCourseNotFound):
+		return c.SendStatus(fiber.StatusNotFound)
+	case errors.Is(err, service.ErrNotOrganizationMember):
+		return c.SendStatus(fiber.StatusForbidden)
+	case err != nil:
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(board)
+}
+
+func handleLeaderboardSettings(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	var request LeaderboardSettingsRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if err := service.SetLeaderboardOptOut(user, request.OptOut); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -1,12 +1,13 @@
 package controller
 
 import (
+	"errors"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
 
-	"gorm.io/gorm/clause"
-
 	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
 	"mehmetfd.dev/chessu-backend/models"
 	"mehmetfd.dev/chessu-backend/service"
 )
@@ -15,13 +16,22 @@ func AssignMembershipHandlers(app *fiber.App) {
 	app.Post("/membership/:userId/cancel", handleCancelMembership)
 	app.Get("/membership/:userId/verify", handleVerifyMembership)
 	app.Post("/membership/:userId/create-checkout-link", handleCreateMembershipCheckoutLink)
+	app.Post("/membership/:userId/change-plan", handleChangeMembershipPlan)
+	app.Get("/membership/plans", handleMembershipPlans)
+}
+
+type MembershipPlanResponseItem struct {
+	Id                 string `json:"id"`
+	Name               string `json:"name"`
+	IncludesAllCourses bool   `json:"includesAllCourses"`
+	Rank               int    `json:"rank"`
 }
 
 func handleCancelMembership(c *fiber.Ctx) error {
 	clerkUserId := utils.CopyString(c.Params("userId"))
 
-	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
@@ -29,7 +39,7 @@ func handleCancelMembership(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	err := service.CancelMembership(user.Id.Bytes)
+	err = service.CancelMembership(user.Id.Bytes)
 
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -41,33 +51,73 @@ func handleCancelMembership(c *fiber.Ctx) error {
 func handleVerifyMembership(c *fiber.Ctx) error {
 	clerkUserId := utils.CopyString(c.Params("userId"))
 
-	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
 		return c.JSON(fiber.Map{
 			"verified": false,
 		})
 	}
 
-	if user.Membership == nil {
-		return c.JSON(fiber.Map{
-			"verified": false,
-		})
+	decision, err := entitlement.ForMembership(user)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	return c.JSON(fiber.Map{
-		"verified": true,
+		"verified":   decision.Allowed,
+		"reason":     decision.Reason,
+		"validUntil": decision.ExpiresAt,
 	})
 }
 
 func handleCreateMembershipCheckoutLink(c *fiber.Ctx) error {
 	clerkUserId := utils.CopyString(c.Params("userId"))
-	url, err := service.GenerateMembershipCheckoutLink(clerkUserId)
+	planId := utils.CopyString(c.Query("planId", models.DefaultMembershipPlanId))
+	link, err := service.GenerateMembershipCheckoutLink(planId, clerkUserId, checkoutOptions(c))
+	return sendCheckoutLink(c, link, err)
+}
 
+func handleChangeMembershipPlan(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	planId := utils.CopyString(c.Query("planId"))
+	if planId == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	membership, err := service.ChangeMembershipPlan(user.Id.Bytes, planId)
+	if errors.Is(err, service.ErrNoMembership) || errors.Is(err, service.ErrMembershipPlanNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if errors.Is(err, service.ErrAlreadyOnMembershipPlan) {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+	if errors.Is(err, service.ErrMembershipPlanCurrency) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	return c.JSON(fiber.Map{
-		"url": url,
+		"planId":     membership.PlanID,
+		"validUntil": membership.ValidUntil,
 	})
 }
+
+func handleMembershipPlans(c *fiber.Ctx) error {
+	responses := make([]MembershipPlanResponseItem, len(database.MembershipPlans))
+	for i, plan := range database.MembershipPlans {
+		responses[i] = MembershipPlanResponseItem{
+			Id:                 plan.Id,
+			Name:               plan.Name,
+			IncludesAllCourses: plan.IncludesAllCourses,
+			Rank:               plan.Rank,
+		}
+	}
+	return c.JSON(responses)
+}
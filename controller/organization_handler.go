@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignOrganizationHandlers(app *fiber.App) {
+	app.Post("/organization/user/:userId", handleCreateOrganization)
+	app.Get("/organization/user/:userId", handleUserOrganizations)
+	app.Get("/organization/:organizationId/user/:userId", handleOrganizationDetails)
+	app.Post("/organization/:organizationId/course/:courseId/user/:userId/create-checkout-link", handleCreateOrganizationCourseCheckoutLink)
+	app.Post("/organization/:organizationId/membership/user/:userId/create-checkout-link", handleCreateOrganizationMembershipCheckoutLink)
+	app.Post("/organization/:organizationId/license/:licenseId/user/:userId/reassign", handleReassignSeat)
+	app.Post("/organization/:organizationId/user/:userId/invite", handleCreateOrganizationInvite)
+	app.Post("/organization/:organizationId/invite/:code/user/:userId/revoke", handleRevokeOrganizationInvite)
+	app.Post("/organization/invite/:code/user/:userId/claim", handleClaimOrganizationInvite)
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type OrganizationInviteRequest struct {
+	LicenseId string `json:"licenseId"`
+	MaxUses   int    `json:"maxUses"`
+}
+
+type ReassignSeatRequest struct {
+	FromUserId string `json:"fromUserId"`
+	ToUserId   string `json:"toUserId"`
+}
+
+type OrganizationResponseItem struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func handleCreateOrganization(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	var request CreateOrganizationRequest
+	if err := c.BodyParser(&request); err != nil || request.Name == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	organization, err := service.CreateOrganization(request.Name, clerkUserId)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.JSON(organizationResponseItem(organization))
+}
+
+func handleUserOrganizations(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	organizations, err := service.GetUserOrganizations(clerkUserId)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+
+	responses := make([]OrganizationResponseItem, len(organizations))
+	for i := range organizations {
+		responses[i] = organizationResponseItem(&organizations[i])
+	}
+	return c.JSON(responses)
+}
+
+func handleOrganizationDetails(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	details, err := service.GetOrganizationDetails(organizationId, clerkUserId)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.JSON(details)
+}
+
+func handleCreateOrganizationCourseCheckoutLink(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	link, err := service.GenerateOrganizationCourseCheckoutLink(organizationId, courseId, clerkUserId, c.QueryInt("quantity", 1), checkoutOptions(c))
+	return sendOrganizationCheckoutLink(c, link, err)
+}
+
+func handleCreateOrganizationMembershipCheckoutLink(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	planId := utils.CopyString(c.Query("planId", models.DefaultMembershipPlanId))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	link, err := service.GenerateOrganizationMembershipCheckoutLink(organizationId, planId, clerkUserId, c.QueryInt("quantity", 1), checkoutOptions(c))
+	return sendOrganizationCheckoutLink(c, link, err)
+}
+
+func sendOrganizationCheckoutLink(c *fiber.Ctx, link *service.CheckoutLink, err error) error {
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.JSON(fiber.Map{
+		"url": link.URL,
+	})
+}
+
+func handleReassignSeat(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	licenseId, err := uuid.Parse(c.Params("licenseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var request ReassignSeatRequest
+	if err := c.BodyParser(&request); err != nil || (request.FromUserId == "" && request.ToUserId == "") {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	err = service.ReassignSeat(organizationId, licenseId, clerkUserId, request.FromUserId, request.ToUserId)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleCreateOrganizationInvite(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var request OrganizationInviteRequest
+	if err := c.BodyParser(&request); err != nil || request.MaxUses < 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	var licenseId *uuid.UUID
+	if request.LicenseId != "" {
+		parsed, err := uuid.Parse(request.LicenseId)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		licenseId = &parsed
+	}
+
+	invite, err := service.CreateOrganizationInvite(organizationId, clerkUserId, licenseId, request.MaxUses)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.JSON(fiber.Map{
+		"code":      invite.Code,
+		"maxUses":   invite.MaxUses,
+		"expiresAt": invite.ExpiresAt,
+	})
+}
+
+func handleRevokeOrganizationInvite(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	code := utils.CopyString(c.Params("code"))
+
+	organizationId, err := uuid.Parse(c.Params("organizationId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if err := service.RevokeOrganizationInvite(organizationId, clerkUserId, code); err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleClaimOrganizationInvite(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+	code := utils.CopyString(c.Params("code"))
+
+	invite, err := service.ClaimOrganizationInvite(code, clerkUserId)
+	if err != nil {
+		return c.SendStatus(organizationErrorStatus(err))
+	}
+
+	organizationId, _ := uuid.FromBytes(invite.OrganizationID.Bytes[:])
+	return c.JSON(fiber.Map{
+		"organizationId": organizationId.String(),
+	})
+}
+
+func organizationResponseItem(organization *models.Organization) OrganizationResponseItem {
+	organizationId, _ := uuid.FromBytes(organization.Id.Bytes[:])
+	return OrganizationResponseItem{
+		Id:        organizationId.String(),
+		Name:      organization.Name,
+		CreatedAt: organization.CreatedAt,
+	}
+}
+
+func organizationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrOrganizationNotFound), errors.Is(err, service.ErrSeatLicenseNotFound),
+		errors.Is(err, service.ErrInviteNotFound), errors.Is(err, service.ErrNotOrganizationMember):
+		return fiber.StatusNotFound
+	case errors.Is(err, service.ErrNotOrganizationAdmin):
+		return fiber.StatusForbidden
+	case errors.Is(err, service.ErrInvalidSeatQuantity):
+		return fiber.StatusBadRequest
+	case errors.Is(err, service.ErrNoSeatsAvailable), errors.Is(err, service.ErrSeatAlreadyAssigned),
+		errors.Is(err, service.ErrSeatNotAssigned), errors.Is(err, service.ErrInviteUsedUp):
+		return fiber.StatusConflict
+	case errors.Is(err, service.ErrInviteExpired), errors.Is(err, service.ErrInviteRevoked):
+		return fiber.StatusGone
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignProgressHandlers(app *fiber.App) {
+	app.Get("/progress/user/:userId/course/:courseId", handleCourseProgress)
+	app.Get("/progress/user/:userId/course/:courseId/history", handleCourseProgressHistory)
+}
+
+func handleCourseProgress(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	progress, err := service.GetCourseProgress(user, courseId)
+	if errors.Is(err, service.ErrCourseNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(progress)
+}
+
+func handleCourseProgressHistory(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	courseId, err := uuid.Parse(c.Params("courseId"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	history, err := service.GetProgressHistory(user.Id.Bytes, courseId)
+	if errors.Is(err, service.ErrMaterialNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(history)
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignReferralHandlers(app *fiber.App) {
+	app.Post("/referral/:code/click", handleReferralClick)
+	app.Get("/referral/user/:userId/code", handleUserReferralCode)
+	app.Get("/referral/partner/user/:userId/report", handlePartnerReport)
+}
+
+func handleReferralClick(c *fiber.Ctx) error {
+	code := utils.CopyString(c.Params("code"))
+
+	if err := service.RecordReferralClick(code); err != nil {
+		return c.SendStatus(referralErrorStatus(err))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleUserReferralCode(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	referralCode, err := service.GetOrCreateUserReferralCode(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"code": referralCode.Code,
+	})
+}
+
+func handlePartnerReport(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	report, err := service.GetPartnerReportForUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(referralErrorStatus(err))
+	}
+	return c.JSON(report)
+}
+
+func referralErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrReferralCodeNotFound), errors.Is(err, service.ErrPartnerNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, service.ErrReferralCodeTaken):
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignStatsHandlers(app *fiber.App) {
+	app.Get("/stats/user/:userId/activity", handleActivityStats)
+	app.Post("/stats/user/:userId/settings", handleUpdateActivitySettings)
+}
+
+func handleActivityStats(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	stats, err := service.GetActivityStats(user)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(stats)
+}
+
+func handleUpdateActivitySettings(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	var settings service.ActivitySettings
+	if err := c.BodyParser(&settings); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	err = service.UpdateActivitySettings(user, settings)
+	if errors.Is(err, service.ErrInvalidTimezone) || errors.Is(err, service.ErrInvalidDailyGoal) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+func AssignVerifyHandlers(app *fiber.App) {
+	app.Post("/verify/user/:userId", handleVerifyBatch)
+}
+
+type VerifyBatchRequest struct {
+	Checks []service.VerificationCheck `json:"checks"`
+}
+
+func handleVerifyBatch(c *fiber.Ctx) error {
+	clerkUserId := utils.CopyString(c.Params("userId"))
+
+	var request VerifyBatchRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	user, err := entitlement.LoadUser(clerkUserId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	results, err := service.VerifyBatch(user, request.Checks)
+	if errors.Is(err, service.ErrUnknownCheck) || errors.Is(err, service.ErrTooManyChecks) || errors.Is(err, service.ErrDuplicateCheckKey) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(results)
+}
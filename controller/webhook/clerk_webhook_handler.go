@@ -51,7 +51,7 @@ func HandleClerkWebhook(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
-	if payload.Type != "user.created" {
+	if payload.Type != "user.created" && payload.Type != "user.updated" {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
@@ -60,7 +60,20 @@ func HandleClerkWebhook(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
-	err = service.CreateUser(clerkUserId)
+	if payload.Type == "user.updated" {
+		if err := service.UpdateUserDisplayName(clerkUserId, service.ClerkDisplayName(payload.Data)); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	// The frontend passes the referral code through Clerk's sign-up metadata
+	var referralCode string
+	if unsafeMetadata, ok := payload.Data["unsafe_metadata"].(map[string]interface{}); ok {
+		referralCode, _ = unsafeMetadata["referralCode"].(string)
+	}
+
+	err = service.CreateUser(clerkUserId, service.ClerkDisplayName(payload.Data), referralCode)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
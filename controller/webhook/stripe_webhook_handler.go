@@ -3,29 +3,20 @@ package webhook
 import (
 	"encoding/json"
 	"errors"
-	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/webhook"
 
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
 	"mehmetfd.dev/chessu-backend/database"
-	"mehmetfd.dev/chessu-backend/lib"
 	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/service"
 )
 
-var (
-	stripeWebhookSecret string
-)
-
-func InitStripeWebhookHandler() {
-	stripeWebhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
-}
-
 func HandleStripeWebhook(c *fiber.Ctx) error {
 	signature := c.Get("Stripe-Signature")
 	payload := c.Request().Body()
@@ -33,7 +24,7 @@ func HandleStripeWebhook(c *fiber.Ctx) error {
 }
 
 func handleStripeWebhookPayload(c *fiber.Ctx, signature string, payload []byte) error {
-	event, err := webhook.ConstructEvent(payload, signature, stripeWebhookSecret)
+	event, err := service.Payments.ConstructEvent(payload, signature)
 	if err != nil {
 		return c.SendStatus(fiber.StatusUnauthorized)
 	}
@@ -51,22 +42,82 @@ func handleStripeWebhookPayload(c *fiber.Ctx, signature string, payload []byte)
 		if err != nil {
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
+		if err := service.AttributeReferral(sessionObj); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
 
 		switch checkoutType {
-		case "course":
+		case "course", "bundle", "cart":
+			courseIds, bundleId, err := service.CheckoutCourseIds(sessionObj)
+			if errors.Is(err, service.ErrBundleNotFound) {
+				return c.SendStatus(fiber.StatusNotFound)
+			}
+			if err != nil {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			return handleCoursePurchase(c, sessionObj, courseIds, bundleId, userUUID)
+		case "gift":
 			courseId, err := uuid.Parse(sessionObj.Metadata["courseId"])
 			if err != nil {
 				return c.SendStatus(fiber.StatusBadRequest)
 			}
-			return handleCoursePurchase(c, courseId, userUUID)
+			if _, err := service.CreateGiftCode(userUUID, courseId, sessionObj); err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			return c.SendStatus(fiber.StatusOK)
 		case "membership":
-			validUntil := time.Unix(sessionObj.ExpiresAt, 0).UTC()
-			subscriptionId := sessionObj.Subscription.ID
-			return handleMembershipPurchase(c, userUUID, subscriptionId, validUntil)
+			if sessionObj.Subscription == nil {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			subscriptionObj, err := service.GetSubscription(sessionObj.Subscription.ID)
+			if err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			planId := sessionObj.Metadata["planId"]
+			if planId == "" {
+				planId = models.DefaultMembershipPlanId
+			}
+			return handleMembershipPurchase(c, userUUID, subscriptionObj, planId)
+		case "organization_course":
+			if err := service.RecordOrganizationPurchase(sessionObj, nil); err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			return c.SendStatus(fiber.StatusOK)
+		case "organization_membership":
+			if sessionObj.Subscription == nil {
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			subscriptionObj, err := service.GetSubscription(sessionObj.Subscription.ID)
+			if err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			if err := service.RecordOrganizationPurchase(sessionObj, subscriptionObj); err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			return c.SendStatus(fiber.StatusOK)
 		default:
 			return errors.New("invalid checkout type")
 		}
 
+	case "checkout.session.expired":
+		sessionObj := &stripe.CheckoutSession{}
+		err := json.Unmarshal(event.Data.Raw, sessionObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		// The trial was claimed when the checkout started
+		if sessionObj.Metadata["type"] != "membership" || sessionObj.Metadata["trial"] != "true" {
+			return c.SendStatus(fiber.StatusOK)
+		}
+		userUUID, err := uuid.Parse(sessionObj.Metadata["userId"])
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if err := service.ReleaseTrial(userUUID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+
 	case "invoice.paid":
 		invoiceObj := &stripe.Invoice{}
 		err := json.Unmarshal(event.Data.Raw, invoiceObj)
@@ -76,67 +127,170 @@ func handleStripeWebhookPayload(c *fiber.Ctx, signature string, payload []byte)
 		subscription := invoiceObj.Lines.Data[0]
 		validUntil := time.Unix(subscription.Period.End, 0).UTC()
 		customerId := invoiceObj.Customer.ID
+		if invoiceObj.Subscription != nil {
+			subscriptionObj, err := service.GetSubscription(invoiceObj.Subscription.ID)
+			if err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			if service.IsOrganizationSubscription(subscriptionObj) {
+				if err := service.ExtendSeatLicense(subscriptionObj.ID, validUntil); err != nil {
+					return c.SendStatus(fiber.StatusInternalServerError)
+				}
+				return c.SendStatus(fiber.StatusOK)
+			}
+		}
 		return handleMembershipRegularPayment(c, customerId, validUntil)
 
+	case "customer.subscription.updated":
+		subscriptionObj := &stripe.Subscription{}
+		err := json.Unmarshal(event.Data.Raw, subscriptionObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		return handleSubscriptionUpdated(c, subscriptionObj)
+
+	case "customer.subscription.deleted":
+		subscriptionObj := &stripe.Subscription{}
+		err := json.Unmarshal(event.Data.Raw, subscriptionObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		return handleSubscriptionDeleted(c, subscriptionObj)
+
 	case "invoice.payment_failed":
 		invoiceObj := &stripe.Invoice{}
 		err := json.Unmarshal(event.Data.Raw, invoiceObj)
 		if err != nil {
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
-		failedCustomerId := invoiceObj.Customer.ID
-		return handleMembershipPaymentFail(c, failedCustomerId)
+		if invoiceObj.Subscription == nil {
+			return c.SendStatus(fiber.StatusOK)
+		}
+		// Seat licenses lapse when Stripe gives up and deletes the subscription
+		subscriptionObj, err := service.GetSubscription(invoiceObj.Subscription.ID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if service.IsOrganizationSubscription(subscriptionObj) {
+			return c.SendStatus(fiber.StatusOK)
+		}
+		return handleMembershipPaymentFail(c, subscriptionObj)
+
+	case "charge.refunded":
+		chargeObj := &stripe.Charge{}
+		err := json.Unmarshal(event.Data.Raw, chargeObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		// A partial refund of a cart cannot be traced to a course, so only
+		// a full refund takes the courses away
+		if !chargeObj.Refunded || chargeObj.PaymentIntent == nil {
+			return c.SendStatus(fiber.StatusOK)
+		}
+		if err := service.RefundPurchases(chargeObj.PaymentIntent.ID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+
+	case "price.updated", "price.deleted":
+		priceObj := &stripe.Price{}
+		err := json.Unmarshal(event.Data.Raw, priceObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if err := service.InvalidateCachedPrice(priceObj.ID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+
+	case "coupon.updated", "coupon.deleted":
+		couponObj := &stripe.Coupon{}
+		err := json.Unmarshal(event.Data.Raw, couponObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if err := service.InvalidateCachedCoupon(couponObj.ID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+
+	case "customer.updated":
+		customerObj := &stripe.Customer{}
+		err := json.Unmarshal(event.Data.Raw, customerObj)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if err := service.InvalidateCachedCustomerCountry(customerObj.ID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
 
 	default:
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 }
 
-func handleCoursePurchase(c *fiber.Ctx, courseId uuid.UUID, userId uuid.UUID) error {
-	coursePtr := database.GetCourse(courseId)
-	if coursePtr == nil {
-		return c.SendStatus(fiber.StatusNotFound)
+func handleCoursePurchase(c *fiber.Ctx, sessionObj *stripe.CheckoutSession, courseIds []uuid.UUID, bundleId *uuid.UUID, userId uuid.UUID) error {
+	for _, courseId := range courseIds {
+		if database.GetCourse(courseId) == nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
 	}
 	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).First(&user, userId).Error; err != nil {
+	if err := database.DB.First(&user, userId).Error; err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	purchasedCourseIds := user.PurchasedCourseId
-	purchasedCourseIds.Append(courseId.String())
-	user.PurchasedCourseId = purchasedCourseIds
-	if err := database.DB.Save(&user).Error; err != nil {
+	if err := service.RecordCoursePurchase(&user, sessionObj, courseIds, bundleId); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func handleMembershipPurchase(c *fiber.Ctx, userId uuid.UUID, subscriptionId string, validUntil time.Time) error {
+func handleMembershipPurchase(c *fiber.Ctx, userId uuid.UUID, subscriptionObj *stripe.Subscription, planId string) error {
 	var user models.AppUser
 	if err := database.DB.Preload(clause.Associations).First(&user, userId).Error; err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
-	membership := user.Membership
-	if membership == nil {
-		var newMembership models.Membership
-		newMembership.ValidUntil = validUntil
-		newMembership.StripeSubscriptionID = subscriptionId
-		newMembership.UserID = lib.UUID{
-			UUID: user.Id.UUID,
-		}
-		membership = &newMembership // Assign the newMembership to membership pointer
+
+	if err := service.ActivateMembership(&user, subscriptionObj, planId); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
+	return c.SendStatus(fiber.StatusOK)
+}
 
-	membershipValidUntil := membership.ValidUntil
-	if membershipValidUntil.Before(validUntil) {
-		membership.ValidUntil = validUntil
-		if err := database.DB.Save(membership).Error; err != nil {
+func handleSubscriptionUpdated(c *fiber.Ctx, subscriptionObj *stripe.Subscription) error {
+	if service.IsOrganizationSubscription(subscriptionObj) {
+		if err := service.SyncSeatLicense(subscriptionObj); err != nil {
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
+		return c.SendStatus(fiber.StatusOK)
 	}
 
-	user.Membership = membership
-	if err := database.DB.Save(&user).Error; err != nil { // Save the pointer to user
+	var membership models.Membership
+	err := database.DB.Where("stripe_subscription_id = ?", subscriptionObj.ID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The checkout.session.completed event creates the membership
+		return c.SendStatus(fiber.StatusOK)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if err := service.SyncMembership(&membership, subscriptionObj); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleSubscriptionDeleted(c *fiber.Ctx, subscriptionObj *stripe.Subscription) error {
+	if service.IsOrganizationSubscription(subscriptionObj) {
+		if err := service.EndSeatLicense(subscriptionObj.ID); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	}
+	if err := service.EndMembership(subscriptionObj.ID); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	return c.SendStatus(fiber.StatusOK)
@@ -156,6 +310,10 @@ func handleMembershipRegularPayment(c *fiber.Ctx, stripeCustomerId string, valid
 	if membership.ValidUntil.Before(validUntil) {
 		membership.ValidUntil = validUntil
 	}
+	// A paid invoice settles a membership whose earlier payment failed
+	if membership.Status == models.MembershipStatusPastDue || membership.Status == models.MembershipStatusUnpaid {
+		membership.Status = models.MembershipStatusActive
+	}
 
 	if err := database.DB.Save(membership).Error; err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -169,21 +327,22 @@ func handleMembershipRegularPayment(c *fiber.Ctx, stripeCustomerId string, valid
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func handleMembershipPaymentFail(c *fiber.Ctx, stripeCustomerId string) error {
-	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).Where("stripe_id = ?", stripeCustomerId).First(&user).Error; err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+// handleMembershipPaymentFail marks the membership past due while Stripe
+// retries the payment. It ends with customer.subscription.deleted if Stripe
+// gives up.
+func handleMembershipPaymentFail(c *fiber.Ctx, subscriptionObj *stripe.Subscription) error {
+	var membership models.Membership
+	err := database.DB.Where("stripe_subscription_id = ?", subscriptionObj.ID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// A first payment that fails never completes checkout
+		return c.SendStatus(fiber.StatusOK)
 	}
-	existingMembership := user.Membership
-	user.Membership = nil
-
-	if err := database.DB.Save(user).Error; err != nil {
+	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	if err := database.DB.Delete(existingMembership).Error; err != nil {
+	if err := service.SyncMembership(&membership, subscriptionObj); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-
 	return c.SendStatus(fiber.StatusOK)
 }
@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/payment"
+	"mehmetfd.dev/chessu-backend/service"
+)
+
+const testWebhookSecret = "whsec_test"
+
+var initDB sync.Once
+
+// useTestDB connects to the Postgres and Redis configured by the usual
+// POSTGRES_* and REDIS_* variables, and skips the test when either is
+// missing. Checkout caches prices in Redis.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("POSTGRES_HOST") == "" || os.Getenv("REDIS_HOST") == "" {
+		t.Skip("POSTGRES_HOST or REDIS_HOST is not set")
+	}
+	initDB.Do(func() {
+		database.InitDB()
+		database.InitRedis()
+	})
+}
+
+// useFakePayments swaps the payment provider for a fake until the test ends.
+func useFakePayments(t *testing.T) *payment.Fake {
+	t.Helper()
+	previous := service.Payments
+	fake := payment.NewFake(testWebhookSecret)
+	service.Payments = fake
+	t.Cleanup(func() { service.Payments = previous })
+	return fake
+}
+
+// postWebhook sends a Stripe webhook request through handleStripeWebhookPayload.
+func postWebhook(t *testing.T, payload []byte, signature string) int {
+	t.Helper()
+	app := fiber.New()
+	app.Post("/webhook", func(c *fiber.Ctx) error {
+		return handleStripeWebhookPayload(c, c.Get("Stripe-Signature"), c.Body())
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	request.Header.Set("Stripe-Signature", signature)
+	response, err := app.Test(request)
+	if err != nil {
+		t.Fatalf("webhook request: %v", err)
+	}
+	return response.StatusCode
+}
+
+func TestStripeWebhookRejectsBadSignature(t *testing.T) {
+	useFakePayments(t)
+	payload, signature, err := payment.NewFake("whsec_other").SignedEvent("invoice.paid", map[string]string{"id": "in_test"})
+	if err != nil {
+		t.Fatalf("SignedEvent: %v", err)
+	}
+
+	if status := postWebhook(t, payload, signature); status != fiber.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", status, fiber.StatusUnauthorized)
+	}
+}
+
+func TestStripeWebhookRejectsUnknownEvent(t *testing.T) {
+	fake := useFakePayments(t)
+	payload, signature, err := fake.SignedEvent("customer.tax_id.created", map[string]string{"id": "txi_test"})
+	if err != nil {
+		t.Fatalf("SignedEvent: %v", err)
+	}
+
+	if status := postWebhook(t, payload, signature); status != fiber.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, fiber.StatusBadRequest)
+	}
+}
+
+func TestStripeWebhookRejectsCheckoutWithoutMetadata(t *testing.T) {
+	fake := useFakePayments(t)
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"no metadata", nil},
+		{"no user", map[string]string{"type": "course", "courseId": uuid.NewString()}},
+		{"malformed user", map[string]string{"type": "course", "userId": "not-a-uuid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &stripe.CheckoutSession{ID: "cs_test", Metadata: tt.metadata}
+			payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+			if err != nil {
+				t.Fatalf("SignedEvent: %v", err)
+			}
+
+			if status := postWebhook(t, payload, signature); status != fiber.StatusBadRequest {
+				t.Errorf("status = %d, want %d", status, fiber.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestStripeWebhookCoursePurchase(t *testing.T) {
+	useTestDB(t)
+	fake := useFakePayments(t)
+	fake.AddPrice("price_course", "usd", 5000)
+
+	courseId := uuid.New()
+	previousMaterials := database.Materials
+	database.Materials = []models.Course{{
+		Id:            lib.NewUUID(courseId),
+		Title:         "Test Course",
+		StripePriceId: "price_course",
+	}}
+	t.Cleanup(func() { database.Materials = previousMaterials })
+
+	user := models.AppUser{ClerkId: "user_test_" + uuid.NewString()}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	t.Cleanup(func() {
+		database.DB.Where("user_id = ?", user.Id).Delete(&models.Purchase{})
+		database.DB.Delete(&user)
+	})
+
+	link, err := service.GenerateCourseCheckoutLink(courseId, user.ClerkId, service.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("GenerateCourseCheckoutLink: %v", err)
+	}
+	sessionId := link.URL[strings.LastIndex(link.URL, "/")+1:]
+
+	payload, signature, err := fake.CompleteCheckoutSession(sessionId)
+	if err != nil {
+		t.Fatalf("CompleteCheckoutSession: %v", err)
+	}
+	if status := postWebhook(t, payload, signature); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want %d", status, fiber.StatusOK)
+	}
+
+	var purchase models.Purchase
+	err = database.DB.Where("user_id = ? AND course_id = ?", user.Id, courseId).First(&purchase).Error
+	if err != nil {
+		t.Fatalf("loading purchase: %v", err)
+	}
+	if purchase.Status != models.PurchaseStatusCompleted || purchase.StripeCheckoutSessionID != sessionId || purchase.AmountTotal != 5000 {
+		t.Errorf("purchase = %s %s %d, want completed %s 5000", purchase.Status, purchase.StripeCheckoutSessionID, purchase.AmountTotal, sessionId)
+	}
+
+	// Stripe retries deliveries, and a repeat must not fail or double up
+	if status := postWebhook(t, payload, signature); status != fiber.StatusOK {
+		t.Errorf("redelivery status = %d, want %d", status, fiber.StatusOK)
+	}
+
+	// A full refund takes the course away again
+	payload, signature, err = fake.RefundPaymentIntent(purchase.StripePaymentIntentID)
+	if err != nil {
+		t.Fatalf("RefundPaymentIntent: %v", err)
+	}
+	if status := postWebhook(t, payload, signature); status != fiber.StatusOK {
+		t.Fatalf("refund status = %d, want %d", status, fiber.StatusOK)
+	}
+	if err := database.DB.First(&purchase, "id = ?", purchase.Id).Error; err != nil {
+		t.Fatalf("reloading purchase: %v", err)
+	}
+	if purchase.Status != models.PurchaseStatusRefunded {
+		t.Errorf("purchase status after refund = %s, want %s", purchase.Status, models.PurchaseStatusRefunded)
+	}
+}
@@ -41,6 +41,34 @@ func InitDB() {
 	DB = db
 
 	// Migrate the schema
-	db.AutoMigrate(&models.AppUser{}, &models.Membership{})
+	db.AutoMigrate(
+		&models.AppUser{},
+		&models.Membership{},
+		&models.Purchase{},
+		&models.AccessGrant{},
+		&models.GiftCode{},
+		&models.PromotionRule{},
+		&models.StripeCustomerJob{},
+		&models.Organization{},
+		&models.OrganizationMember{},
+		&models.SeatLicense{},
+		&models.SeatAssignment{},
+		&models.OrganizationInvite{},
+		&models.Partner{},
+		&models.ReferralCode{},
+		&models.ReferralClick{},
+		&models.CommissionEntry{},
+		&models.ContentProgress{},
+		&models.ContentProgressArchive{},
+		&models.DailyActivity{},
+		&models.StreakFreeze{},
+		&models.XPEvent{},
+		&models.UserAchievement{},
+		&models.Certificate{},
+	)
+
+	backfillPurchases()
+	dropStripeIdUniqueConstraint()
+	backfillContentProgress()
 
 }
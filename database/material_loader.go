@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
@@ -15,6 +16,13 @@ import (
 )
 
 var Materials []models.Course = []models.Course{}
+var Bundles []models.Bundle = []models.Bundle{}
+var MembershipPlans []models.MembershipPlan = []models.MembershipPlan{}
+
+const (
+	bundleKeyPrefix = "bundles/"
+	planKeyPrefix   = "plans/"
+)
 
 func LoadMaterials() {
 	ctx := context.Background()
@@ -50,6 +58,26 @@ func LoadMaterials() {
 		if err != nil {
 			panic(err)
 		}
+		if strings.HasPrefix(*content.Key, bundleKeyPrefix) {
+			var b models.Bundle
+			err = json.Unmarshal(contentBytes, &b)
+			if err != nil {
+				panic(err)
+			}
+			Bundles = append(Bundles, b)
+			continue
+		}
+
+		if strings.HasPrefix(*content.Key, planKeyPrefix) {
+			var p models.MembershipPlan
+			err = json.Unmarshal(contentBytes, &p)
+			if err != nil {
+				panic(err)
+			}
+			MembershipPlans = append(MembershipPlans, p)
+			continue
+		}
+
 		var c models.Course
 		err = json.Unmarshal(contentBytes, &c)
 		if err != nil {
@@ -57,6 +85,26 @@ func LoadMaterials() {
 		}
 		Materials = append(Materials, c)
 	}
+
+	// Memberships bought before plans existed have the default plan ID, so
+	// it stays registered even once the catalog has plans of its own
+	if GetMembershipPlan(models.DefaultMembershipPlanId) == nil {
+		MembershipPlans = append(MembershipPlans, models.MembershipPlan{
+			Id:            models.DefaultMembershipPlanId,
+			Name:          "Membership",
+			StripePriceId: os.Getenv("MEMBERSHIP_STRIPE_PRICE_ID"),
+			CouponId:      os.Getenv("MEMBERSHIP_COUPON_ID"),
+		})
+	}
+}
+
+func GetBundle(bundleId uuid.UUID) *models.Bundle {
+	for _, bundle := range Bundles {
+		if bundle.Id.UUID.Bytes == bundleId {
+			return &bundle
+		}
+	}
+	return nil
 }
 
 func GetCourse(courseId uuid.UUID) *models.Course {
@@ -68,6 +116,15 @@ func GetCourse(courseId uuid.UUID) *models.Course {
 	return nil
 }
 
+func GetMembershipPlan(planId string) *models.MembershipPlan {
+	for _, plan := range MembershipPlans {
+		if plan.Id == planId {
+			return &plan
+		}
+	}
+	return nil
+}
+
 func GetCourseAndChapter(chapterId uuid.UUID) (*models.Course, *models.Chapter) {
 	for _, course := range Materials {
 		for _, chapter := range course.Chapters {
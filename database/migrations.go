@@ -0,0 +1,59 @@
+package database
+
+import (
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// backfillPurchases copies the legacy purchased_course_id array into the
+// purchases table. It is safe to run on every start.
+func backfillPurchases() {
+	if !DB.Migrator().HasColumn(&models.AppUser{}, "purchased_course_id") {
+		return
+	}
+
+	err := DB.Exec(`
+		INSERT INTO purchases (user_id, course_id, status, created_at, updated_at)
+		SELECT app_users.id, legacy.course_id, ?, now(), now()
+		FROM app_users, unnest(app_users.purchased_course_id) AS legacy(course_id)
+		ON CONFLICT (user_id, course_id) DO NOTHING
+	`, models.PurchaseStatusCompleted).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// dropStripeIdUniqueConstraint replaces the old unique constraint on
+// app_users.stripe_id, which only allowed one user at a time to be waiting
+// for a Stripe customer, with the partial index on AppUser.StripeId.
+func dropStripeIdUniqueConstraint() {
+	err := DB.Exec(`ALTER TABLE app_users DROP CONSTRAINT IF EXISTS app_users_stripe_id_key`).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// backfillContentProgress copies the legacy completed_content_id array into
+// content_progress. Like backfillPurchases it is safe to run on every start:
+// content with archived progress was reset after the copy and is skipped, so
+// resets are not undone. The column itself is left in place until every
+// instance runs this release, and is dropped in a later migration.
+func backfillContentProgress() {
+	if !DB.Migrator().HasColumn(&models.AppUser{}, "completed_content_id") {
+		return
+	}
+
+	err := DB.Exec(`
+		INSERT INTO content_progress (user_id, content_id, status, first_started_at, completed_at, time_spent_seconds, attempts, updated_at)
+		SELECT app_users.id, legacy.content_id, ?, now(), now(), 0, 0, now()
+		FROM app_users, unnest(app_users.completed_content_id) AS legacy(content_id)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM content_progress_archives
+			WHERE content_progress_archives.user_id = app_users.id
+			AND content_progress_archives.content_id = legacy.content_id
+		)
+		ON CONFLICT (user_id, content_id) DO NOTHING
+	`, models.ContentProgressStatusCompleted).Error
+	if err != nil {
+		panic(err)
+	}
+}
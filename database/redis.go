@@ -0,0 +1,29 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	Redis *redis.Client
+)
+
+func InitRedis() {
+	redisHost := os.Getenv("REDIS_HOST")
+	redisPort := os.Getenv("REDIS_PORT")
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%s", redisHost, redisPort),
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		panic(err)
+	}
+
+	Redis = client
+}
@@ -0,0 +1,278 @@
+package entitlement
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+type Reason string
+
+const (
+	ReasonPurchased    Reason = "purchased"
+	ReasonMembership   Reason = "membership"
+	ReasonTrial        Reason = "trial"
+	ReasonSample       Reason = "sample"
+	ReasonGift         Reason = "gift"
+	ReasonAdminGrant   Reason = "admin_grant"
+	ReasonOrganization Reason = "organization"
+	ReasonLocked       Reason = "locked"
+	ReasonExpired      Reason = "expired"
+	ReasonNone         Reason = "none"
+)
+
+var ErrNotFound = errors.New("material not found")
+
+// Decision is the answer to "can this user access this item", together with
+// the reason it was given or refused.
+type Decision struct {
+	Allowed   bool       `json:"allowed"`
+	Reason    Reason     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Lock      *Lock      `json:"lock,omitempty"`
+}
+
+// Owned reports whether the access is the user's to keep, as opposed to
+// lasting only while a membership is active, covering just a sample or
+// depending on a seat the organization can take back.
+func (d Decision) Owned() bool {
+	return d.Allowed && d.Reason != ReasonMembership && d.Reason != ReasonSample && d.Reason != ReasonOrganization
+}
+
+func allow(reason Reason, expiresAt *time.Time) Decision {
+	return Decision{Allowed: true, Reason: reason, ExpiresAt: expiresAt}
+}
+
+func deny(reason Reason, expiresAt *time.Time) Decision {
+	return Decision{Allowed: false, Reason: reason, ExpiresAt: expiresAt}
+}
+
+// LoadUser loads a user by Clerk ID with everything entitlement checks need.
+func LoadUser(clerkUserId string) (*models.AppUser, error) {
+	var user models.AppUser
+	if err := database.DB.Preload(clause.Associations).Where(&models.AppUser{ClerkId: clerkUserId}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func HasActiveMembership(user *models.AppUser) bool {
+	if user.Membership == nil || !user.Membership.ValidUntil.After(time.Now()) {
+		return false
+	}
+	status := user.Membership.Status
+	return status == models.MembershipStatusActive || status == models.MembershipStatusTrialing
+}
+
+// MembershipPlan returns the plan of the user's active membership, or nil.
+func MembershipPlan(user *models.AppUser) *models.MembershipPlan {
+	if !HasActiveMembership(user) {
+		return nil
+	}
+	return database.GetMembershipPlan(user.Membership.PlanID)
+}
+
+func planIncludesCourse(plan *models.MembershipPlan, courseId uuid.UUID) bool {
+	if plan.IncludesAllCourses {
+		return true
+	}
+	for _, includedCourseId := range plan.IncludedCourseIds {
+		if includedCourseId.Bytes == courseId {
+			return true
+		}
+	}
+	return false
+}
+
+func ForMembership(user *models.AppUser) (Decision, error) {
+	if HasActiveMembership(user) {
+		validUntil := user.Membership.ValidUntil
+		if user.Membership.Status == models.MembershipStatusTrialing {
+			return allow(ReasonTrial, &validUntil), nil
+		}
+		return allow(ReasonMembership, &validUntil), nil
+	}
+
+	licenses, err := activeSeatLicenses(user.Id.Bytes)
+	if err != nil {
+		return Decision{}, err
+	}
+	for _, license := range licenses {
+		if license.CourseID == nil {
+			return allow(ReasonOrganization, license.ValidUntil), nil
+		}
+	}
+
+	if user.Membership == nil {
+		return deny(ReasonNone, nil), nil
+	}
+	validUntil := user.Membership.ValidUntil
+	return deny(ReasonExpired, &validUntil), nil
+}
+
+func ForCourse(user *models.AppUser, courseId uuid.UUID) (Decision, error) {
+	if database.GetCourse(courseId) == nil {
+		return Decision{}, ErrNotFound
+	}
+
+	purchased, err := HasPurchasedCourse(user.Id.Bytes, courseId)
+	if err != nil {
+		return Decision{}, err
+	}
+	if purchased {
+		return allow(ReasonPurchased, nil), nil
+	}
+
+	decision, err := forGrants(user, courseId)
+	if err != nil || decision.Allowed {
+		return decision, err
+	}
+
+	if plan := MembershipPlan(user); plan != nil && planIncludesCourse(plan, courseId) {
+		validUntil := user.Membership.ValidUntil
+		return allow(ReasonMembership, &validUntil), nil
+	}
+
+	organizationDecision, err := forOrganization(user, courseId)
+	if err != nil || organizationDecision.Allowed {
+		return organizationDecision, err
+	}
+
+	return decision, nil
+}
+
+// ForChapter also refuses chapters the user can access but has not
+// unlocked yet, with the lock in the decision.
+func ForChapter(user *models.AppUser, chapterId uuid.UUID) (Decision, error) {
+	coursePtr, chapterPtr := database.GetCourseAndChapter(chapterId)
+	if coursePtr == nil {
+		return Decision{}, ErrNotFound
+	}
+
+	decision, err := ForCourse(user, coursePtr.Id.Bytes)
+	if err != nil {
+		return decision, err
+	}
+	if !decision.Allowed {
+		if !chapterPtr.IsSample {
+			return decision, nil
+		}
+		decision = allow(ReasonSample, nil)
+	}
+
+	if !hasLocks(coursePtr) {
+		return decision, nil
+	}
+	progress, err := loadProgress(user)
+	if err != nil {
+		return Decision{}, err
+	}
+	completedPrerequisites, err := loadCompletedPrerequisites(user, coursePtr, progress)
+	if err != nil {
+		return Decision{}, err
+	}
+	for i := range coursePtr.Chapters {
+		if coursePtr.Chapters[i].Id.Bytes != chapterPtr.Id.Bytes {
+			continue
+		}
+		if lock := chapterLock(coursePtr, i, progress, completedPrerequisites); lock != nil {
+			return locked(lock), nil
+		}
+	}
+	return decision, nil
+}
+
+func ForContent(user *models.AppUser, contentId uuid.UUID) (Decision, error) {
+	_, chapterPtr, _ := database.GetCourseAndChapterAndContent(contentId)
+	if chapterPtr == nil {
+		return Decision{}, ErrNotFound
+	}
+	return ForChapter(user, chapterPtr.Id.Bytes)
+}
+
+// AccessibleCourseIds lists every course the user can open in full.
+func AccessibleCourseIds(user *models.AppUser) ([]uuid.UUID, error) {
+	courseIds, err := GetPurchasedCourseIds(user.Id.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	grants, err := activeGrants(user.Id.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, grant := range grants {
+		courseIds = append(courseIds, grant.CourseID.Bytes)
+	}
+
+	plans := []*models.MembershipPlan{}
+	if plan := MembershipPlan(user); plan != nil {
+		plans = append(plans, plan)
+	}
+
+	licenses, err := activeSeatLicenses(user.Id.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, license := range licenses {
+		if license.CourseID != nil {
+			courseIds = append(courseIds, license.CourseID.Bytes)
+		} else if plan := database.GetMembershipPlan(license.PlanID); plan != nil {
+			plans = append(plans, plan)
+		}
+	}
+
+	for _, plan := range plans {
+		for _, course := range database.Materials {
+			if planIncludesCourse(plan, course.Id.Bytes) {
+				courseIds = append(courseIds, course.Id.Bytes)
+			}
+		}
+	}
+
+	return courseIds, nil
+}
+
+func forGrants(user *models.AppUser, courseId uuid.UUID) (Decision, error) {
+	var grants []models.AccessGrant
+	err := database.DB.Where("user_id = ? AND course_id = ? AND revoked_at IS NULL", user.Id, courseId).
+		Find(&grants).Error
+	if err != nil {
+		return Decision{}, err
+	}
+
+	now := time.Now()
+	var expired *time.Time
+	for _, grant := range grants {
+		if grant.ExpiresAt != nil && !grant.ExpiresAt.After(now) {
+			expired = grant.ExpiresAt
+			continue
+		}
+		return allow(grantReason(grant), grant.ExpiresAt), nil
+	}
+
+	if expired != nil {
+		return deny(ReasonExpired, expired), nil
+	}
+	return deny(ReasonNone, nil), nil
+}
+
+func activeGrants(userId uuid.UUID) ([]models.AccessGrant, error) {
+	var grants []models.AccessGrant
+	err := database.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userId, time.Now()).
+		Find(&grants).Error
+	return grants, err
+}
+
+func grantReason(grant models.AccessGrant) Reason {
+	if grant.Source == models.AccessGrantSourceGift {
+		return ReasonGift
+	}
+	return ReasonAdminGrant
+}
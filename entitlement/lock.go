@@ -0,0 +1,218 @@
+package entitlement
+
+import (
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	LockPrerequisiteCourse = "prerequisite_course"
+	LockPreviousChapter    = "previous_chapter"
+	LockQuizScore          = "quiz_score"
+)
+
+// Lock says what has to happen before a course or chapter opens up.
+type Lock struct {
+	Kind         string   `json:"kind"`
+	CourseId     string   `json:"courseId,omitempty"`
+	ChapterId    string   `json:"chapterId,omitempty"`
+	ContentId    string   `json:"contentId,omitempty"`
+	MinimumScore *float64 `json:"minimumScore,omitempty"`
+}
+
+func locked(lock *Lock) Decision {
+	return Decision{Allowed: false, Reason: ReasonLocked, Lock: lock}
+}
+
+func hasLocks(course *models.Course) bool {
+	if len(course.PrerequisiteCourseIds) > 0 {
+		return true
+	}
+	for _, chapter := range course.Chapters {
+		if chapter.Unlock != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProgress reads all of the user's content progress, keyed by content.
+func loadProgress(user *models.AppUser) (map[uuid.UUID]models.ContentProgress, error) {
+	var rows []models.ContentProgress
+	if err := database.DB.Where("user_id = ?", user.Id).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	progress := make(map[uuid.UUID]models.ContentProgress, len(rows))
+	for _, row := range rows {
+		progress[row.ContentID.Bytes] = row
+	}
+	return progress, nil
+}
+
+// loadCompletedPrerequisites finds the prerequisites of the course the user
+// completed on an earlier attempt, so that resetting a course does not lock
+// the courses that build on it. A certificate counts, as does having
+// completed every content either now or before a reset.
+func loadCompletedPrerequisites(user *models.AppUser, course *models.Course, progress map[uuid.UUID]models.ContentProgress) (map[uuid.UUID]bool, error) {
+	completed := map[uuid.UUID]bool{}
+	if len(course.PrerequisiteCourseIds) == 0 {
+		return completed, nil
+	}
+
+	var certificates []models.Certificate
+	err := database.DB.Where("user_id = ? AND course_id IN ?", user.Id, course.PrerequisiteCourseIds).Find(&certificates).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, certificate := range certificates {
+		completed[certificate.CourseID.Bytes] = true
+	}
+
+	var archivedIds []lib.UUID
+	err = database.DB.Model(&models.ContentProgressArchive{}).
+		Where("user_id = ? AND completed_at IS NOT NULL", user.Id).
+		Distinct().
+		Pluck("content_id", &archivedIds).Error
+	if err != nil {
+		return nil, err
+	}
+	archived := make(map[uuid.UUID]bool, len(archivedIds))
+	for _, id := range archivedIds {
+		archived[id.Bytes] = true
+	}
+
+	for _, prerequisiteId := range course.PrerequisiteCourseIds {
+		prerequisite := database.GetCourse(prerequisiteId.Bytes)
+		if prerequisite == nil || completed[prerequisiteId.Bytes] {
+			continue
+		}
+		completed[prerequisiteId.Bytes] = everyContent(prerequisite, func(contentId uuid.UUID) bool {
+			return archived[contentId] || contentCompleted(progress, contentId)
+		})
+	}
+	return completed, nil
+}
+
+func everyContent(course *models.Course, done func(contentId uuid.UUID) bool) bool {
+	for _, chapter := range course.Chapters {
+		for _, content := range chapter.Contents {
+			if !done(content.Id.Bytes) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contentCompleted(progress map[uuid.UUID]models.ContentProgress, contentId uuid.UUID) bool {
+	row, ok := progress[contentId]
+	return ok && row.Status == models.ContentProgressStatusCompleted
+}
+
+func chapterCompleted(progress map[uuid.UUID]models.ContentProgress, chapter *models.Chapter) bool {
+	for _, content := range chapter.Contents {
+		if !contentCompleted(progress, content.Id.Bytes) {
+			return false
+		}
+	}
+	return true
+}
+
+// courseLock is the first unmet prerequisite of the course, or nil.
+// Prerequisites in completedPrerequisites are met whatever the progress.
+func courseLock(course *models.Course, progress map[uuid.UUID]models.ContentProgress, completedPrerequisites map[uuid.UUID]bool) *Lock {
+	for _, prerequisiteId := range course.PrerequisiteCourseIds {
+		prerequisite := database.GetCourse(prerequisiteId.Bytes)
+		if prerequisite == nil || completedPrerequisites[prerequisiteId.Bytes] {
+			continue
+		}
+		for i := range prerequisite.Chapters {
+			if !chapterCompleted(progress, &prerequisite.Chapters[i]) {
+				return &Lock{Kind: LockPrerequisiteCourse, CourseId: uuid.UUID(prerequisiteId.Bytes).String()}
+			}
+		}
+	}
+	return nil
+}
+
+// chapterLock is the first unmet condition keeping the chapter locked,
+// including the prerequisites of its course, or nil.
+func chapterLock(course *models.Course, chapterIndex int, progress map[uuid.UUID]models.ContentProgress, completedPrerequisites map[uuid.UUID]bool) *Lock {
+	if lock := courseLock(course, progress, completedPrerequisites); lock != nil {
+		return lock
+	}
+
+	rule := course.Chapters[chapterIndex].Unlock
+	if rule == nil {
+		return nil
+	}
+	if rule.AfterPreviousChapter && chapterIndex > 0 {
+		previous := &course.Chapters[chapterIndex-1]
+		if !chapterCompleted(progress, previous) {
+			return &Lock{Kind: LockPreviousChapter, ChapterId: uuid.UUID(previous.Id.Bytes).String()}
+		}
+	}
+	if rule.QuizContentId != nil {
+		row, ok := progress[rule.QuizContentId.Bytes]
+		if !ok || row.Score == nil || *row.Score < rule.MinimumScore {
+			minimumScore := rule.MinimumScore
+			return &Lock{
+				Kind:         LockQuizScore,
+				ContentId:    uuid.UUID(rule.QuizContentId.Bytes).String(),
+				MinimumScore: &minimumScore,
+			}
+		}
+	}
+	return nil
+}
+
+// ChapterLocks reports the lock on each chapter of the course, in order,
+// with nil for chapters that are open.
+func ChapterLocks(user *models.AppUser, course *models.Course) ([]*Lock, error) {
+	locks := make([]*Lock, len(course.Chapters))
+	if !hasLocks(course) {
+		return locks, nil
+	}
+
+	progress, err := loadProgress(user)
+	if err != nil {
+		return nil, err
+	}
+	completedPrerequisites, err := loadCompletedPrerequisites(user, course, progress)
+	if err != nil {
+		return nil, err
+	}
+	for i := range course.Chapters {
+		locks[i] = chapterLock(course, i, progress, completedPrerequisites)
+	}
+	return locks, nil
+}
+
+// ForCourseUnlocked is ForCourse, also refusing a course whose prerequisites
+// are not completed yet.
+func ForCourseUnlocked(user *models.AppUser, courseId uuid.UUID) (Decision, error) {
+	decision, err := ForCourse(user, courseId)
+	if err != nil || !decision.Allowed {
+		return decision, err
+	}
+
+	course := database.GetCourse(courseId)
+	if len(course.PrerequisiteCourseIds) == 0 {
+		return decision, nil
+	}
+	progress, err := loadProgress(user)
+	if err != nil {
+		return Decision{}, err
+	}
+	completedPrerequisites, err := loadCompletedPrerequisites(user, course, progress)
+	if err != nil {
+		return Decision{}, err
+	}
+	if lock := courseLock(course, progress, completedPrerequisites); lock != nil {
+		return locked(lock), nil
+	}
+	return decision, nil
+}
@@ -0,0 +1,128 @@
+package entitlement
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// useMaterials swaps the loaded catalog for the given courses until the
+// test ends.
+func useMaterials(t *testing.T, courses ...models.Course) {
+	t.Helper()
+	previous := database.Materials
+	database.Materials = courses
+	t.Cleanup(func() { database.Materials = previous })
+}
+
+func newChapter(contents int, unlock *models.UnlockRule) models.Chapter {
+	chapter := models.Chapter{Id: lib.NewUUID(uuid.New()), Unlock: unlock}
+	for i := 0; i < contents; i++ {
+		chapter.Contents = append(chapter.Contents, models.Content{Id: lib.NewUUID(uuid.New())})
+	}
+	return chapter
+}
+
+func completed(contents ...models.Content) map[uuid.UUID]models.ContentProgress {
+	progress := map[uuid.UUID]models.ContentProgress{}
+	for _, content := range contents {
+		progress[content.Id.Bytes] = models.ContentProgress{ContentID: content.Id, Status: models.ContentProgressStatusCompleted}
+	}
+	return progress
+}
+
+func TestCourseLockAfterPrerequisiteReset(t *testing.T) {
+	prerequisite := models.Course{
+		Id:       lib.NewUUID(uuid.New()),
+		Chapters: []models.Chapter{newChapter(2, nil)},
+	}
+	course := models.Course{
+		Id:                    lib.NewUUID(uuid.New()),
+		Chapters:              []models.Chapter{newChapter(1, nil)},
+		PrerequisiteCourseIds: []lib.UUID{prerequisite.Id},
+	}
+	useMaterials(t, prerequisite, course)
+	prerequisiteId := uuid.UUID(prerequisite.Id.Bytes)
+
+	tests := []struct {
+		name                   string
+		progress               map[uuid.UUID]models.ContentProgress
+		completedPrerequisites map[uuid.UUID]bool
+		wantLocked             bool
+	}{
+		{"not started", nil, nil, true},
+		{"partly done", completed(prerequisite.Chapters[0].Contents[0]), nil, true},
+		{"completed", completed(prerequisite.Chapters[0].Contents...), nil, false},
+		// Resetting the prerequisite clears its progress, but what was
+		// completed before still counts
+		{"reset without earlier completion", nil, map[uuid.UUID]bool{}, true},
+		{"reset after completing it", nil, map[uuid.UUID]bool{prerequisiteId: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := courseLock(&course, tt.progress, tt.completedPrerequisites)
+			if (lock != nil) != tt.wantLocked {
+				t.Fatalf("lock = %+v, want locked %v", lock, tt.wantLocked)
+			}
+			if lock != nil && (lock.Kind != LockPrerequisiteCourse || lock.CourseId != prerequisiteId.String()) {
+				t.Errorf("lock = %+v, want prerequisite %s", lock, prerequisiteId)
+			}
+		})
+	}
+}
+
+func TestChapterLock(t *testing.T) {
+	prerequisite := models.Course{
+		Id:       lib.NewUUID(uuid.New()),
+		Chapters: []models.Chapter{newChapter(1, nil)},
+	}
+	opening := newChapter(1, nil)
+	followUp := newChapter(1, &models.UnlockRule{AfterPreviousChapter: true})
+	quiz := followUp.Contents[0]
+	final := newChapter(1, &models.UnlockRule{QuizContentId: &quiz.Id, MinimumScore: 0.8})
+	course := models.Course{
+		Id:       lib.NewUUID(uuid.New()),
+		Chapters: []models.Chapter{opening, followUp, final},
+	}
+	gated := course
+	gated.PrerequisiteCourseIds = []lib.UUID{prerequisite.Id}
+	useMaterials(t, prerequisite, course)
+
+	scored := func(score float64) map[uuid.UUID]models.ContentProgress {
+		progress := completed(opening.Contents[0])
+		progress[quiz.Id.Bytes] = models.ContentProgress{ContentID: quiz.Id, Status: models.ContentProgressStatusCompleted, Score: &score}
+		return progress
+	}
+
+	tests := []struct {
+		name         string
+		course       *models.Course
+		chapterIndex int
+		progress     map[uuid.UUID]models.ContentProgress
+		wantKind     string
+	}{
+		{"open chapter", &course, 0, nil, ""},
+		{"previous chapter not done", &course, 1, nil, LockPreviousChapter},
+		{"previous chapter done", &course, 1, completed(opening.Contents[0]), ""},
+		{"quiz not taken", &course, 2, completed(opening.Contents[0]), LockQuizScore},
+		{"quiz score too low", &course, 2, scored(0.5), LockQuizScore},
+		{"quiz score reached", &course, 2, scored(0.8), ""},
+		{"prerequisite locks every chapter", &gated, 0, nil, LockPrerequisiteCourse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := chapterLock(tt.course, tt.chapterIndex, tt.progress, nil)
+			kind := ""
+			if lock != nil {
+				kind = lock.Kind
+			}
+			if kind != tt.wantKind {
+				t.Errorf("lock = %+v, want kind %q", lock, tt.wantKind)
+			}
+		})
+	}
+}
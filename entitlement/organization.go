@@ -0,0 +1,42 @@
+package entitlement
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// activeSeatLicenses lists the licenses the user holds a seat of, leaving
+// out membership licenses whose subscription has lapsed.
+func activeSeatLicenses(userId uuid.UUID) ([]models.SeatLicense, error) {
+	var licenses []models.SeatLicense
+	err := database.DB.
+		Joins("JOIN seat_assignments ON seat_assignments.license_id = seat_licenses.id").
+		Where("seat_assignments.user_id = ? AND seat_assignments.revoked_at IS NULL", userId).
+		Where("seat_licenses.valid_until IS NULL OR seat_licenses.valid_until > ?", time.Now()).
+		Find(&licenses).Error
+	return licenses, err
+}
+
+func forOrganization(user *models.AppUser, courseId uuid.UUID) (Decision, error) {
+	licenses, err := activeSeatLicenses(user.Id.Bytes)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	for _, license := range licenses {
+		if license.CourseID != nil {
+			if license.CourseID.Bytes == courseId {
+				return allow(ReasonOrganization, nil), nil
+			}
+			continue
+		}
+		if plan := database.GetMembershipPlan(license.PlanID); plan != nil && planIncludesCourse(plan, courseId) {
+			return allow(ReasonOrganization, license.ValidUntil), nil
+		}
+	}
+	return deny(ReasonNone, nil), nil
+}
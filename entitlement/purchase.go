@@ -0,0 +1,35 @@
+package entitlement
+
+import (
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+func HasPurchasedCourse(userId uuid.UUID, courseId uuid.UUID) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.Purchase{}).
+		Where("user_id = ? AND course_id = ? AND status = ?", userId, courseId, models.PurchaseStatusCompleted).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func GetPurchasedCourseIds(userId uuid.UUID) ([]uuid.UUID, error) {
+	var purchases []models.Purchase
+	err := database.DB.Where("user_id = ? AND status = ?", userId, models.PurchaseStatusCompleted).
+		Order("created_at").
+		Find(&purchases).Error
+	if err != nil {
+		return nil, err
+	}
+
+	courseIds := make([]uuid.UUID, len(purchases))
+	for i, purchase := range purchases {
+		courseIds[i] = purchase.CourseID.Bytes
+	}
+	return courseIds, nil
+}
@@ -8,9 +8,11 @@ require github.com/joho/godotenv v1.5.1
 
 require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.26
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/gofiber/fiber/v2 v2.47.0
 	github.com/jackc/pgtype v1.14.0
 	github.com/redis/go-redis/v9 v9.0.5
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stripe/stripe-go/v74 v74.24.0
 	github.com/svix/svix-webhooks v1.5.2
 )
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+// Ambiguous characters such as 0/O and 1/I are left out so codes can be
+// read aloud or typed from a printout.
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// RandomCode returns groups of random characters joined by dashes, e.g.
+// RandomCode(3, 4) gives "ABCD-EFGH-JKLM".
+func RandomCode(groups int, groupLength int) (string, error) {
+	parts := make([]string, groups)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range parts {
+		var part strings.Builder
+		for j := 0; j < groupLength; j++ {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			part.WriteByte(codeAlphabet[n.Int64()])
+		}
+		parts[i] = part.String()
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// NormalizeCode undoes what typing or pasting a code tends to do to it:
+// lower case letters and surrounding spaces.
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -16,6 +16,12 @@ type UUIDArray struct {
 	pgtype.UUIDArray
 }
 
+func NewUUID(id uuid.UUID) UUID {
+	return UUID{
+		UUID: pgtype.UUID{Bytes: id, Status: pgtype.Present},
+	}
+}
+
 func (a *UUIDArray) Append(uuid string) error {
 	uuidValue := pgtype.UUID{}
 	err := uuidValue.Set(uuid)
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
@@ -46,19 +47,46 @@ func main() {
 	}
 	verifyEnvironmentVariables()
 	database.InitDB()
+	database.InitRedis()
 	database.LoadMaterials()
 	service.InitStripe()
+	service.StartStripeCustomerWorker()
+	service.StartHeartbeatFlusher()
+	service.RebuildLeaderboards()
+	service.BackfillRewards()
+	service.BackfillDisplayNames()
+
+	// Optional, e.g. RECONCILE_INTERVAL=6h
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		duration, err := time.ParseDuration(interval)
+		if err != nil {
+			panic(err)
+		}
+		service.StartReconciliationSchedule(duration, os.Getenv("RECONCILE_DRY_RUN") == "true")
+	}
 
 	app := fiber.New()
 
 	controller.AssignMembershipHandlers(app)
 	controller.AssignCompletionHandlers(app)
+	controller.AssignProgressHandlers(app)
+	controller.AssignStatsHandlers(app)
+	controller.AssignAchievementHandlers(app)
+	controller.AssignLeaderboardHandlers(app)
+	controller.AssignCertificateHandlers(app)
 
 	controller.AssignCoursePurchaseHandlers(app)
+	controller.AssignGiftHandlers(app)
 
 	controller.AssignHomepageHandlers(app)
+	controller.AssignAccessHandlers(app)
+	controller.AssignVerifyHandlers(app)
+	controller.AssignAdminHandlers(app)
 
 	controller.AssignMembershipHandlers(app)
+	controller.AssignBillingHandlers(app)
+	controller.AssignOrganizationHandlers(app)
+	controller.AssignReferralHandlers(app)
 	webhook.AssignWebhookHandlers(app)
 
 	port := os.Getenv("APPLICATION_PORT")
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+const (
+	AccessGrantSourceGift  = "gift"
+	AccessGrantSourceAdmin = "admin"
+)
+
+// AccessGrant gives a user a course without a purchase of their own.
+type AccessGrant struct {
+	Id        lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    lib.UUID `gorm:"type:uuid;index"`
+	CourseID  lib.UUID `gorm:"type:uuid;index"`
+	Source    string   `gorm:"type:text"`
+	Note      string   `gorm:"type:text"`
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+const (
+	XPSourceContent     = "content"
+	XPSourceAchievement = "achievement"
+	// Milestones pay no XP of their own; they are in the ledger so that
+	// each completed course and perfect chapter is counted once
+	XPSourceCourse         = "course"
+	XPSourcePerfectChapter = "perfect_chapter"
+)
+
+// XPEvent is one entry in a user's XP ledger. A source can only pay out once
+// per user, which is what makes awarding idempotent.
+type XPEvent struct {
+	Id       lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID   lib.UUID `gorm:"type:uuid;uniqueIndex:idx_xp_event_user_source"`
+	Source   string   `gorm:"type:text;uniqueIndex:idx_xp_event_user_source"`
+	SourceID string   `gorm:"type:text;uniqueIndex:idx_xp_event_user_source"`
+	// ContentType is set on content events so they can be counted by type
+	ContentType string `gorm:"type:text;not null;default:''"`
+	Amount      int
+	CreatedAt   time.Time
+}
+
+type UserAchievement struct {
+	Id            lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID        lib.UUID `gorm:"type:uuid;uniqueIndex:idx_user_achievement"`
+	AchievementID string   `gorm:"type:text;uniqueIndex:idx_user_achievement"`
+	EarnedAt      time.Time
+}
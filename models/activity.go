@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// DailyActivity sums up what a user did on one calendar day in their own
+// timezone.
+type DailyActivity struct {
+	Id                lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID            lib.UUID  `gorm:"type:uuid;uniqueIndex:idx_daily_activity_user_day"`
+	Day               time.Time `gorm:"type:date;uniqueIndex:idx_daily_activity_user_day"`
+	CompletedContents int
+	Attempts          int
+	Seconds           int64
+}
+
+// StreakFreeze is a missed day that a member's streak survived.
+type StreakFreeze struct {
+	Id        lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    lib.UUID  `gorm:"type:uuid;uniqueIndex:idx_streak_freeze_user_day"`
+	Day       time.Time `gorm:"type:date;uniqueIndex:idx_streak_freeze_user_day"`
+	CreatedAt time.Time
+}
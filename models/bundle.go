@@ -0,0 +1,12 @@
+package models
+
+import "mehmetfd.dev/chessu-backend/lib"
+
+// Bundle is a set of courses sold together under a single Stripe price.
+type Bundle struct {
+	Id            lib.UUID   `json:"id"`
+	CourseIds     []lib.UUID `json:"courseIds"`
+	StripePriceId string     `json:"stripePriceId"`
+	// StripePriceIds holds regional prices, keyed like Course.StripePriceIds
+	StripePriceIds map[string]string `json:"stripePriceIds"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// Certificate records that a user completed a course. The recipient name
+// and course title are kept as issued, so later renames do not change what
+// the certificate says. Its Id is the public certificate number.
+type Certificate struct {
+	Id            lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID        lib.UUID `gorm:"type:uuid;uniqueIndex:idx_certificate_user_course"`
+	CourseID      lib.UUID `gorm:"type:uuid;uniqueIndex:idx_certificate_user_course"`
+	RecipientName string   `gorm:"type:text"`
+	CourseTitle   string   `gorm:"type:text"`
+	IssuedAt      time.Time
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+const (
+	ContentProgressStatusStarted   = "started"
+	ContentProgressStatusCompleted = "completed"
+)
+
+// ContentProgress is one user's progress on one piece of content. Score is
+// the best score over all attempts.
+type ContentProgress struct {
+	Id               lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID           lib.UUID `gorm:"type:uuid;uniqueIndex:idx_content_progress_user_content"`
+	ContentID        lib.UUID `gorm:"type:uuid;uniqueIndex:idx_content_progress_user_content"`
+	Status           string   `gorm:"type:text"`
+	FirstStartedAt   time.Time
+	CompletedAt      *time.Time
+	TimeSpentSeconds int64
+	Attempts         int
+	Score            *float64
+	UpdatedAt        time.Time
+}
+
+func (ContentProgress) TableName() string {
+	return "content_progress"
+}
+
+const (
+	ProgressResetByUser  = "user"
+	ProgressResetByAdmin = "admin"
+
+	ProgressResetUncomplete = "uncomplete"
+	ProgressResetReset      = "reset"
+)
+
+// ContentProgressArchive keeps a progress row as it was before the user
+// un-completed or reset it. Rows archived by the same reset share a ResetID,
+// which together make up one earlier attempt.
+type ContentProgressArchive struct {
+	Id               lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ResetID          lib.UUID `gorm:"type:uuid;index"`
+	UserID           lib.UUID `gorm:"type:uuid;index:idx_content_progress_archive_user_content"`
+	ContentID        lib.UUID `gorm:"type:uuid;index:idx_content_progress_archive_user_content"`
+	Status           string   `gorm:"type:text"`
+	FirstStartedAt   time.Time
+	CompletedAt      *time.Time
+	TimeSpentSeconds int64
+	Attempts         int
+	Score            *float64
+	UpdatedAt        time.Time
+	Reason           string `gorm:"type:text"`
+	ResetBy          string `gorm:"type:text"`
+	Note             string `gorm:"type:text"`
+	ArchivedAt       time.Time
+}
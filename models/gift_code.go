@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// GiftCode is a paid course that the buyer hands to someone else. It can be
+// redeemed once, before it expires and unless it has been revoked.
+type GiftCode struct {
+	Id                      lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Code                    string   `gorm:"type:text;uniqueIndex"`
+	BuyerID                 lib.UUID `gorm:"type:uuid;index"`
+	CourseID                lib.UUID `gorm:"type:uuid"`
+	AmountTotal             int64
+	Currency                string `gorm:"type:text"`
+	StripeCheckoutSessionID string `gorm:"type:text;uniqueIndex"`
+	StripePaymentIntentID   string `gorm:"type:text"`
+	ExpiresAt               time.Time
+	RedeemedByID            *lib.UUID `gorm:"type:uuid"`
+	RedeemedAt              *time.Time
+	AccessGrantID           *lib.UUID `gorm:"type:uuid"`
+	RevokedAt               *time.Time
+	CreatedAt               time.Time
+}
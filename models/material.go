@@ -4,16 +4,49 @@ import "mehmetfd.dev/chessu-backend/lib"
 
 type Course struct {
 	Id            lib.UUID  `json:"id"`
+	Title         string    `json:"title"`
 	Chapters      []Chapter `json:"chapters"`
 	StripePriceId string    `json:"stripePriceId"`
+	// StripePriceIds holds regional prices keyed by "currency" or
+	// "currency-COUNTRY", e.g. "eur" or "inr-IN"
+	StripePriceIds map[string]string `json:"stripePriceIds"`
+	// PrerequisiteCourseIds must all be completed before any chapter of
+	// this course unlocks
+	PrerequisiteCourseIds []lib.UUID `json:"prerequisiteCourseIds"`
 }
 
 type Chapter struct {
 	Id       lib.UUID  `json:"id"`
 	Contents []Content `json:"contents"`
 	IsSample bool      `json:"isSample"`
+	// Unlock is nil for chapters that are open from the start
+	Unlock *UnlockRule `json:"unlock"`
 }
 
+// UnlockRule lists what a chapter waits for. Every condition that is set
+// must hold. Chapters are ordered as they appear in the course.
+type UnlockRule struct {
+	AfterPreviousChapter bool `json:"afterPreviousChapter"`
+	// QuizContentId, when set, must have been scored at least MinimumScore
+	QuizContentId *lib.UUID `json:"quizContentId"`
+	MinimumScore  float64   `json:"minimumScore"`
+}
+
+const (
+	ContentTypeLesson = "lesson"
+	ContentTypeVideo  = "video"
+	ContentTypePuzzle = "puzzle"
+	ContentTypeQuiz   = "quiz"
+)
+
 type Content struct {
 	Id lib.UUID `json:"id"`
+	// Type is one of the ContentType constants. Older materials have none
+	// and are treated as lessons.
+	Type string `json:"type"`
+	// Rating is a puzzle's difficulty on the same scale as player ratings
+	Rating int `json:"rating"`
+	// MinimumSeconds is the time a student must spend on the content before
+	// it can be completed. Zero means no minimum.
+	MinimumSeconds int `json:"minimumSeconds"`
 }
@@ -0,0 +1,23 @@
+package models
+
+import "mehmetfd.dev/chessu-backend/lib"
+
+// DefaultMembershipPlanId is the plan built from MEMBERSHIP_STRIPE_PRICE_ID
+// and MEMBERSHIP_COUPON_ID when the catalog defines no plans.
+const DefaultMembershipPlanId = "default"
+
+type MembershipPlan struct {
+	Id            string `json:"id"`
+	Name          string `json:"name"`
+	StripePriceId string `json:"stripePriceId"`
+	// StripePriceIds holds regional prices, keyed like Course.StripePriceIds
+	StripePriceIds map[string]string `json:"stripePriceIds"`
+	// CouponId is the discount members of this plan get on course purchases
+	CouponId           string     `json:"couponId"`
+	IncludedCourseIds  []lib.UUID `json:"includedCourseIds"`
+	IncludesAllCourses bool       `json:"includesAllCourses"`
+	// TrialDays is the free trial a user gets on their first membership
+	TrialDays int `json:"trialDays"`
+	// Rank orders plans so that moving to a higher rank is an upgrade
+	Rank int `json:"rank"`
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+const (
+	OrganizationRoleAdmin  = "admin"
+	OrganizationRoleMember = "member"
+)
+
+// Organization is a club or school that buys seats for its members. It has
+// its own Stripe customer so that its invoices never touch the personal
+// membership of whoever paid for them.
+type Organization struct {
+	Id        lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Name      string   `gorm:"type:text"`
+	StripeId  string   `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+type OrganizationMember struct {
+	Id             lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	OrganizationID lib.UUID `gorm:"type:uuid;uniqueIndex:idx_organization_member"`
+	UserID         lib.UUID `gorm:"type:uuid;uniqueIndex:idx_organization_member;index"`
+	Role           string   `gorm:"type:text"`
+	CreatedAt      time.Time
+}
+
+// SeatLicense is a number of seats bought for a course, or for a membership
+// plan when CourseID is nil. Membership seats last while the subscription
+// is paid, course seats forever.
+type SeatLicense struct {
+	Id                      lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	OrganizationID          lib.UUID  `gorm:"type:uuid;index"`
+	CourseID                *lib.UUID `gorm:"type:uuid"`
+	PlanID                  string    `gorm:"type:text"`
+	Quantity                int
+	StripeCheckoutSessionID string `gorm:"type:text;uniqueIndex"`
+	StripeSubscriptionID    string `gorm:"type:text;index"`
+	ValidUntil              *time.Time
+	CreatedAt               time.Time
+}
+
+// SeatAssignment gives one seat of a license to a member. Reassigning a
+// seat revokes the old assignment and creates a new one.
+type SeatAssignment struct {
+	Id        lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	LicenseID lib.UUID `gorm:"type:uuid;index"`
+	UserID    lib.UUID `gorm:"type:uuid;index"`
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// OrganizationInvite is a link that adds whoever opens it to the
+// organization and, if LicenseID is set, gives them a seat of that license.
+type OrganizationInvite struct {
+	Id             lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	OrganizationID lib.UUID  `gorm:"type:uuid;index"`
+	LicenseID      *lib.UUID `gorm:"type:uuid"`
+	Code           string    `gorm:"type:text;uniqueIndex"`
+	MaxUses        int
+	Uses           int
+	ExpiresAt      time.Time
+	RevokedAt      *time.Time
+	CreatedAt      time.Time
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// PromotionRule adds local restrictions on top of a Stripe promotion code
+// with the same code. Empty course or user lists mean no restriction.
+type PromotionRule struct {
+	Id                         lib.UUID      `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Code                       string        `gorm:"type:text;uniqueIndex"`
+	CourseIds                  lib.UUIDArray `gorm:"type:uuid[];default:'{}'"`
+	UserIds                    lib.UUIDArray `gorm:"type:uuid[];default:'{}'"`
+	FirstPurchaseOnly          bool
+	ReplacesMembershipDiscount bool
+	ExpiresAt                  *time.Time
+	CreatedAt                  time.Time
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+const (
+	PurchaseStatusCompleted = "completed"
+	PurchaseStatusRefunded  = "refunded"
+)
+
+type Purchase struct {
+	Id                      lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID                  lib.UUID  `gorm:"type:uuid;uniqueIndex:idx_purchase_user_course"`
+	CourseID                lib.UUID  `gorm:"type:uuid;uniqueIndex:idx_purchase_user_course"`
+	BundleID                *lib.UUID `gorm:"type:uuid"`
+	AmountTotal             int64
+	AmountDiscount          int64
+	Currency                string `gorm:"type:text"`
+	CouponID                string `gorm:"type:text"`
+	StripeCheckoutSessionID string `gorm:"type:text;index"`
+	StripePaymentIntentID   string `gorm:"type:text;index"`
+	Status                  string `gorm:"type:text;default:'completed'"`
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// Partner is an affiliate, such as a streamer, who is paid a commission on
+// the sales their referral codes bring in.
+type Partner struct {
+	Id                lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Name              string    `gorm:"type:text"`
+	UserID            *lib.UUID `gorm:"type:uuid;index"`
+	CommissionPercent float64
+	CreatedAt         time.Time
+}
+
+// ReferralCode belongs to either a partner or a user. CommissionPercent
+// overrides the partner's rate when set.
+type ReferralCode struct {
+	Id                lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Code              string    `gorm:"type:text;uniqueIndex"`
+	PartnerID         *lib.UUID `gorm:"type:uuid;index"`
+	UserID            *lib.UUID `gorm:"type:uuid;index"`
+	CommissionPercent *float64
+	CreatedAt         time.Time
+}
+
+type ReferralClick struct {
+	Id             lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ReferralCodeID lib.UUID `gorm:"type:uuid;index"`
+	CreatedAt      time.Time
+}
+
+// CommissionEntry is one attributed sale in the commission ledger. Amounts
+// are in minor units of Currency.
+type CommissionEntry struct {
+	Id                      lib.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ReferralCodeID          lib.UUID  `gorm:"type:uuid;index"`
+	PartnerID               *lib.UUID `gorm:"type:uuid;index"`
+	BuyerID                 lib.UUID  `gorm:"type:uuid"`
+	CheckoutType            string    `gorm:"type:text"`
+	StripeCheckoutSessionID string    `gorm:"type:text;uniqueIndex"`
+	AmountTotal             int64
+	Currency                string `gorm:"type:text"`
+	CommissionPercent       float64
+	CommissionAmount        int64
+	CreatedAt               time.Time
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"mehmetfd.dev/chessu-backend/lib"
+)
+
+// StripeCustomerJob is a pending or finished attempt to create the Stripe
+// customer of a user.
+type StripeCustomerJob struct {
+	Id            lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID        lib.UUID `gorm:"type:uuid;uniqueIndex"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string    `gorm:"type:text"`
+	CompletedAt   *time.Time
+	CreatedAt     time.Time
+}
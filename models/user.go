@@ -7,17 +7,42 @@ import (
 )
 
 type AppUser struct {
-	Id                 lib.UUID      `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	ClerkId            string        `gorm:"unique"`
-	StripeId           string        `gorm:"unique"`
-	CompletedContentId lib.UUIDArray `gorm:"type:uuid[];default:'{}'"`
-	PurchasedCourseId  lib.UUIDArray `gorm:"type:uuid[];default:'{}'"`
-	Membership         *Membership   `gorm:"foreignKey:UserID"`
+	Id             lib.UUID    `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ClerkId        string      `gorm:"unique"`
+	DisplayName    string      `gorm:"type:text"`
+	StripeId       string      `gorm:"uniqueIndex:idx_app_users_stripe_id,where:stripe_id <> ''"`
+	Membership     *Membership `gorm:"foreignKey:UserID"`
+	TrialUsedAt    *time.Time
+	ReferralCodeID *lib.UUID `gorm:"type:uuid"`
+	// Timezone is an IANA name such as "Europe/Istanbul". Days for streaks
+	// and daily goals start at midnight there.
+	Timezone string `gorm:"type:text;default:'UTC'"`
+	// Daily goals, zero when not set
+	DailyGoalContents int
+	DailyGoalMinutes  int
+	PuzzleRating      int `gorm:"default:1500"`
+	LeaderboardOptOut bool
 }
 
+// Membership statuses follow the Stripe subscription's. Only active and
+// trialing memberships give access.
+const (
+	MembershipStatusActive   = "active"
+	MembershipStatusTrialing = "trialing"
+	MembershipStatusPastDue  = "past_due"
+	MembershipStatusUnpaid   = "unpaid"
+	MembershipStatusPaused   = "paused"
+	// Checkout has not collected the first payment yet
+	MembershipStatusIncomplete = "incomplete"
+	MembershipStatusCanceled   = "canceled"
+)
+
 type Membership struct {
 	Id                   lib.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	UserID               lib.UUID `gorm:"type:uuid"`
 	StripeSubscriptionID string   `gorm:"type:text"`
+	PlanID               string   `gorm:"type:text;default:'default'"`
+	Status               string   `gorm:"type:text;default:'active'"`
 	ValidUntil           time.Time
+	TrialEndsAt          *time.Time
 }
@@ -0,0 +1,554 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+const fakeBillingPeriod = 30 * 24 * time.Hour
+
+var ErrFakeNotFound = errors.New("fake payment provider: resource not found")
+
+// Fake is an in-memory Provider for tests and local development. Seed it
+// with AddPrice, AddCoupon and AddPromotionCode, then drive purchases with
+// CompleteCheckoutSession and feed the signed events it returns to the
+// webhook handler.
+type Fake struct {
+	mu            sync.Mutex
+	webhookSecret string
+	nextId        int
+
+	Customers        map[string]*stripe.Customer
+	CheckoutSessions map[string]*stripe.CheckoutSession
+	Subscriptions    map[string]*stripe.Subscription
+	Prices           map[string]*stripe.Price
+	Coupons          map[string]*stripe.Coupon
+	PromotionCodes   map[string]*stripe.PromotionCode
+	Invoices         []*stripe.Invoice
+	PaymentIntents   []*stripe.PaymentIntent
+
+	checkoutParams  map[string]*stripe.CheckoutSessionParams
+	lineItems       map[string][]*stripe.LineItem
+	idempotencyKeys map[string]string
+}
+
+func NewFake(webhookSecret string) *Fake {
+	return &Fake{
+		webhookSecret:    webhookSecret,
+		Customers:        map[string]*stripe.Customer{},
+		CheckoutSessions: map[string]*stripe.CheckoutSession{},
+		Subscriptions:    map[string]*stripe.Subscription{},
+		Prices:           map[string]*stripe.Price{},
+		Coupons:          map[string]*stripe.Coupon{},
+		PromotionCodes:   map[string]*stripe.PromotionCode{},
+		checkoutParams:   map[string]*stripe.CheckoutSessionParams{},
+		lineItems:        map[string][]*stripe.LineItem{},
+		idempotencyKeys:  map[string]string{},
+	}
+}
+
+func (f *Fake) newId(prefix string) string {
+	f.nextId++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.nextId)
+}
+
+func (f *Fake) AddPrice(id string, currency string, unitAmount int64) *stripe.Price {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := &stripe.Price{
+		ID:         id,
+		Active:     true,
+		Currency:   stripe.Currency(currency),
+		UnitAmount: unitAmount,
+	}
+	f.Prices[id] = p
+	return p
+}
+
+func (f *Fake) AddCoupon(c *stripe.Coupon) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Coupons[c.ID] = c
+}
+
+func (f *Fake) AddPromotionCode(p *stripe.PromotionCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p.ID == "" {
+		p.ID = f.newId("promo")
+	}
+	f.PromotionCodes[strings.ToLower(p.Code)] = p
+}
+
+func (f *Fake) CreateCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if params.IdempotencyKey != nil {
+		if id, ok := f.idempotencyKeys[*params.IdempotencyKey]; ok {
+			return f.Customers[id], nil
+		}
+	}
+
+	c := &stripe.Customer{
+		ID:       f.newId("cus"),
+		Metadata: params.Metadata,
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	f.Customers[c.ID] = c
+	if params.IdempotencyKey != nil {
+		f.idempotencyKeys[*params.IdempotencyKey] = c.ID
+	}
+	return c, nil
+}
+
+func (f *Fake) GetCustomer(id string) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.Customers[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+	return c, nil
+}
+
+func (f *Fake) CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, lineItem := range params.LineItems {
+		if _, ok := f.Prices[stripe.StringValue(lineItem.Price)]; !ok {
+			return nil, ErrFakeNotFound
+		}
+	}
+
+	s := &stripe.CheckoutSession{
+		ID:         f.newId("cs"),
+		Mode:       stripe.CheckoutSessionMode(stripe.StringValue(params.Mode)),
+		Metadata:   params.Metadata,
+		SuccessURL: stripe.StringValue(params.SuccessURL),
+		Status:     stripe.CheckoutSessionStatusOpen,
+		Created:    time.Now().Unix(),
+		ExpiresAt:  time.Now().Add(24 * time.Hour).Unix(),
+	}
+	s.URL = "https://checkout.fake/" + s.ID
+	if params.Customer != nil {
+		s.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+
+	f.CheckoutSessions[s.ID] = s
+	f.checkoutParams[s.ID] = params
+	return s, nil
+}
+
+// ListCheckoutSessionLineItems returns the line items of a completed
+// session; open sessions have none yet.
+func (f *Fake) ListCheckoutSessionLineItems(sessionId string) ([]*stripe.LineItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.CheckoutSessions[sessionId]; !ok {
+		return nil, ErrFakeNotFound
+	}
+	return f.lineItems[sessionId], nil
+}
+
+func (f *Fake) CreateBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.newId("bps")
+	return &stripe.BillingPortalSession{
+		ID:        id,
+		Customer:  stripe.StringValue(params.Customer),
+		ReturnURL: stripe.StringValue(params.ReturnURL),
+		URL:       "https://billing.fake/" + id,
+	}, nil
+}
+
+func (f *Fake) GetSubscription(id string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.Subscriptions[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+	return s, nil
+}
+
+func (f *Fake) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.Subscriptions[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+
+	for _, itemParams := range params.Items {
+		for _, item := range s.Items.Data {
+			if item.ID != stripe.StringValue(itemParams.ID) {
+				continue
+			}
+			if itemParams.Price != nil {
+				p, ok := f.Prices[*itemParams.Price]
+				if !ok {
+					return nil, ErrFakeNotFound
+				}
+				item.Price = p
+			}
+			if itemParams.Quantity != nil {
+				item.Quantity = *itemParams.Quantity
+			}
+		}
+	}
+	for key, value := range params.Metadata {
+		if s.Metadata == nil {
+			s.Metadata = map[string]string{}
+		}
+		s.Metadata[key] = value
+	}
+	return s, nil
+}
+
+func (f *Fake) CancelSubscription(id string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.Subscriptions[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+	s.Status = stripe.SubscriptionStatusCanceled
+	s.CanceledAt = time.Now().Unix()
+	return s, nil
+}
+
+func (f *Fake) GetPrice(id string) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.Prices[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+	return p, nil
+}
+
+func (f *Fake) GetCoupon(id string) (*stripe.Coupon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.Coupons[id]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+	return c, nil
+}
+
+func (f *Fake) FindPromotionCode(code string) (*stripe.PromotionCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.PromotionCodes[strings.ToLower(code)]
+	if !ok || !p.Active {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (f *Fake) ListInvoices(customerId string, limit int) ([]*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	invoices := []*stripe.Invoice{}
+	for i := len(f.Invoices) - 1; i >= 0 && len(invoices) < limit; i-- {
+		if f.Invoices[i].Customer != nil && f.Invoices[i].Customer.ID == customerId {
+			invoices = append(invoices, f.Invoices[i])
+		}
+	}
+	return invoices, nil
+}
+
+func (f *Fake) ListPaymentIntents(customerId string, limit int) ([]*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	paymentIntents := []*stripe.PaymentIntent{}
+	for i := len(f.PaymentIntents) - 1; i >= 0 && len(paymentIntents) < limit; i-- {
+		if f.PaymentIntents[i].Customer != nil && f.PaymentIntents[i].Customer.ID == customerId {
+			paymentIntents = append(paymentIntents, f.PaymentIntents[i])
+		}
+	}
+	return paymentIntents, nil
+}
+
+func (f *Fake) ListCustomers() ([]*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	customers := []*stripe.Customer{}
+	for _, c := range f.Customers {
+		customers = append(customers, c)
+	}
+	return customers, nil
+}
+
+func (f *Fake) ListSubscriptions() ([]*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscriptions := []*stripe.Subscription{}
+	for _, s := range f.Subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, nil
+}
+
+func (f *Fake) ListCheckoutSessions(createdAfter time.Time) ([]*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sessions := []*stripe.CheckoutSession{}
+	for _, s := range f.CheckoutSessions {
+		if s.Created >= createdAfter.Unix() {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (f *Fake) ConstructEvent(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, f.webhookSecret)
+}
+
+// CompleteCheckoutSession pays for a checkout session as if the customer had
+// gone through Stripe Checkout. It creates the payment intent or
+// subscription and returns a signed checkout.session.completed event.
+func (f *Fake) CompleteCheckoutSession(id string) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.CheckoutSessions[id]
+	params := f.checkoutParams[id]
+	if !ok {
+		return nil, "", ErrFakeNotFound
+	}
+
+	var subtotal int64
+	var currency stripe.Currency
+	lineItems := make([]*stripe.LineItem, len(params.LineItems))
+	for i, lineItem := range params.LineItems {
+		p := f.Prices[stripe.StringValue(lineItem.Price)]
+		lineItems[i] = &stripe.LineItem{
+			ID:             f.newId("li"),
+			Price:          p,
+			Quantity:       stripe.Int64Value(lineItem.Quantity),
+			Currency:       p.Currency,
+			AmountSubtotal: p.UnitAmount * stripe.Int64Value(lineItem.Quantity),
+		}
+		subtotal += lineItems[i].AmountSubtotal
+		currency = p.Currency
+	}
+	discount := f.discountFor(params, subtotal, currency)
+
+	// Like Stripe, the discount is spread over the line items in proportion
+	// to their amounts
+	remaining := discount
+	for i, lineItem := range lineItems {
+		if subtotal > 0 && i < len(lineItems)-1 {
+			lineItem.AmountDiscount = discount * lineItem.AmountSubtotal / subtotal
+		} else {
+			lineItem.AmountDiscount = remaining
+		}
+		remaining -= lineItem.AmountDiscount
+		lineItem.AmountTotal = lineItem.AmountSubtotal - lineItem.AmountDiscount
+	}
+	f.lineItems[id] = lineItems
+
+	s.Status = stripe.CheckoutSessionStatusComplete
+	s.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	s.Currency = currency
+	s.AmountSubtotal = subtotal
+	s.AmountTotal = subtotal - discount
+	s.TotalDetails = &stripe.CheckoutSessionTotalDetails{AmountDiscount: discount}
+
+	if s.Mode == stripe.CheckoutSessionModeSubscription {
+		s.Subscription = f.createSubscription(params, s)
+	} else {
+		pi := &stripe.PaymentIntent{
+			ID:       f.newId("pi"),
+			Amount:   s.AmountTotal,
+			Currency: currency,
+			Customer: s.Customer,
+			Status:   stripe.PaymentIntentStatusSucceeded,
+			Created:  time.Now().Unix(),
+		}
+		f.PaymentIntents = append(f.PaymentIntents, pi)
+		s.PaymentIntent = &stripe.PaymentIntent{ID: pi.ID}
+	}
+
+	// Built while still locked, so the event has the session exactly as it
+	// was completed even if another call changes it afterwards
+	return f.signedEvent("checkout.session.completed", s)
+}
+
+// ExpireCheckoutSession lets an open checkout session lapse without payment
+// and returns a signed checkout.session.expired event.
+func (f *Fake) ExpireCheckoutSession(id string) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.CheckoutSessions[id]
+	if !ok {
+		return nil, "", ErrFakeNotFound
+	}
+	s.Status = stripe.CheckoutSessionStatusExpired
+	return f.signedEvent("checkout.session.expired", s)
+}
+
+// RefundPaymentIntent refunds a payment in full and returns a signed
+// charge.refunded event.
+func (f *Fake) RefundPaymentIntent(id string) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, pi := range f.PaymentIntents {
+		if pi.ID != id {
+			continue
+		}
+		charge := &stripe.Charge{
+			ID:             f.newId("ch"),
+			Amount:         pi.Amount,
+			AmountRefunded: pi.Amount,
+			Currency:       pi.Currency,
+			Customer:       pi.Customer,
+			PaymentIntent:  &stripe.PaymentIntent{ID: pi.ID},
+			Refunded:       true,
+		}
+		return f.signedEvent("charge.refunded", charge)
+	}
+	return nil, "", ErrFakeNotFound
+}
+
+func (f *Fake) discountFor(params *stripe.CheckoutSessionParams, subtotal int64, currency stripe.Currency) int64 {
+	if len(params.Discounts) == 0 {
+		return 0
+	}
+
+	var c *stripe.Coupon
+	if params.Discounts[0].Coupon != nil {
+		c = f.Coupons[*params.Discounts[0].Coupon]
+	}
+	if params.Discounts[0].PromotionCode != nil {
+		for _, promo := range f.PromotionCodes {
+			if promo.ID == *params.Discounts[0].PromotionCode {
+				c = promo.Coupon
+			}
+		}
+	}
+
+	switch {
+	case c == nil:
+		return 0
+	case c.PercentOff > 0:
+		return int64(math.Round(float64(subtotal) * c.PercentOff / 100))
+	case c.AmountOff > 0 && c.Currency == currency:
+		if c.AmountOff > subtotal {
+			return subtotal
+		}
+		return c.AmountOff
+	}
+	return 0
+}
+
+func (f *Fake) createSubscription(params *stripe.CheckoutSessionParams, s *stripe.CheckoutSession) *stripe.Subscription {
+	now := time.Now()
+	sub := &stripe.Subscription{
+		ID:                 f.newId("sub"),
+		Customer:           s.Customer,
+		Status:             stripe.SubscriptionStatusActive,
+		Created:            now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.Add(fakeBillingPeriod).Unix(),
+		Metadata:           map[string]string{},
+		Items:              &stripe.SubscriptionItemList{},
+	}
+
+	if params.SubscriptionData != nil {
+		for key, value := range params.SubscriptionData.Metadata {
+			sub.Metadata[key] = value
+		}
+	}
+	if params.SubscriptionData != nil && params.SubscriptionData.TrialPeriodDays != nil {
+		trialEnd := now.Add(time.Duration(*params.SubscriptionData.TrialPeriodDays) * 24 * time.Hour)
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = trialEnd.Unix()
+		sub.CurrentPeriodEnd = trialEnd.Unix()
+	}
+
+	for _, lineItem := range params.LineItems {
+		sub.Items.Data = append(sub.Items.Data, &stripe.SubscriptionItem{
+			ID:       f.newId("si"),
+			Price:    f.Prices[stripe.StringValue(lineItem.Price)],
+			Quantity: stripe.Int64Value(lineItem.Quantity),
+		})
+	}
+
+	f.Subscriptions[sub.ID] = sub
+	return &stripe.Subscription{ID: sub.ID}
+}
+
+// SignedEvent wraps an object in a webhook event of the given type and signs
+// it with the fake's webhook secret. It returns the request body and the
+// Stripe-Signature header value.
+func (f *Fake) SignedEvent(eventType string, object interface{}) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.signedEvent(eventType, object)
+}
+
+func (f *Fake) signedEvent(eventType string, object interface{}) ([]byte, string, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, "", err
+	}
+
+	eventId := f.newId("evt")
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          eventId,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"type":        eventType,
+		"created":     time.Now().Unix(),
+		"data": map[string]interface{}{
+			"object": json.RawMessage(raw),
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  f.webhookSecret,
+	})
+	return signed.Payload, signed.Header, nil
+}
@@ -0,0 +1,173 @@
+package payment
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+const testWebhookSecret = "whsec_test"
+
+func TestFakeCompleteCheckoutSession(t *testing.T) {
+	f := NewFake(testWebhookSecret)
+	f.AddPrice("price_course", "usd", 5000)
+	f.AddCoupon(&stripe.Coupon{ID: "coupon_member", PercentOff: 20, Valid: true})
+
+	created, err := f.CreateCheckoutSession(&stripe.CheckoutSessionParams{
+		Mode:     stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer: stripe.String("cus_test"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String("price_course"), Quantity: stripe.Int64(1)},
+		},
+		Discounts: []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String("coupon_member")},
+		},
+		Params: stripe.Params{Metadata: map[string]string{"type": "course"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+	if created.Status != stripe.CheckoutSessionStatusOpen {
+		t.Fatalf("new session status = %q, want open", created.Status)
+	}
+
+	payload, signature, err := f.CompleteCheckoutSession(created.ID)
+	if err != nil {
+		t.Fatalf("CompleteCheckoutSession: %v", err)
+	}
+
+	event, err := f.ConstructEvent(payload, signature)
+	if err != nil {
+		t.Fatalf("ConstructEvent: %v", err)
+	}
+	if event.Type != "checkout.session.completed" {
+		t.Fatalf("event type = %q, want checkout.session.completed", event.Type)
+	}
+
+	var session stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+		t.Fatalf("decoding session: %v", err)
+	}
+	if session.ID != created.ID || session.Metadata["type"] != "course" {
+		t.Errorf("event session = %s %v, want %s with its metadata", session.ID, session.Metadata, created.ID)
+	}
+	if session.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		t.Errorf("payment status = %q, want paid", session.PaymentStatus)
+	}
+	if session.AmountSubtotal != 5000 || session.AmountTotal != 4000 || session.TotalDetails.AmountDiscount != 1000 {
+		t.Errorf("amounts = %d/%d/%d, want 5000/4000/1000", session.AmountSubtotal, session.AmountTotal, session.TotalDetails.AmountDiscount)
+	}
+	if session.PaymentIntent == nil || len(f.PaymentIntents) != 1 || f.PaymentIntents[0].ID != session.PaymentIntent.ID {
+		t.Errorf("payment intent = %v, want the one the fake recorded", session.PaymentIntent)
+	}
+}
+
+func TestFakeCompleteSubscriptionCheckout(t *testing.T) {
+	f := NewFake(testWebhookSecret)
+	f.AddPrice("price_membership", "usd", 1000)
+
+	created, err := f.CreateCheckoutSession(&stripe.CheckoutSessionParams{
+		Mode:     stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		Customer: stripe.String("cus_test"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String("price_membership"), Quantity: stripe.Int64(1)},
+		},
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			TrialPeriodDays: stripe.Int64(7),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+
+	payload, signature, err := f.CompleteCheckoutSession(created.ID)
+	if err != nil {
+		t.Fatalf("CompleteCheckoutSession: %v", err)
+	}
+	event, err := f.ConstructEvent(payload, signature)
+	if err != nil {
+		t.Fatalf("ConstructEvent: %v", err)
+	}
+	var session stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+		t.Fatalf("decoding session: %v", err)
+	}
+	if session.Subscription == nil {
+		t.Fatal("subscription checkout completed without a subscription")
+	}
+
+	sub, err := f.GetSubscription(session.Subscription.ID)
+	if err != nil {
+		t.Fatalf("GetSubscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		t.Errorf("subscription status = %q, want trialing", sub.Status)
+	}
+	if sub.TrialEnd-sub.TrialStart != 7*24*60*60 || sub.CurrentPeriodEnd != sub.TrialEnd {
+		t.Errorf("trial = %d..%d ending period at %d, want 7 days", sub.TrialStart, sub.TrialEnd, sub.CurrentPeriodEnd)
+	}
+}
+
+func TestFakeConstructEventRejectsBadSignature(t *testing.T) {
+	f := NewFake(testWebhookSecret)
+	payload, _, err := f.SignedEvent("invoice.paid", &stripe.Invoice{ID: "in_test"})
+	if err != nil {
+		t.Fatalf("SignedEvent: %v", err)
+	}
+
+	_, signature, err := NewFake("whsec_other").SignedEvent("invoice.paid", &stripe.Invoice{ID: "in_test"})
+	if err != nil {
+		t.Fatalf("SignedEvent: %v", err)
+	}
+	if _, err := f.ConstructEvent(payload, signature); err == nil {
+		t.Error("ConstructEvent accepted a payload signed with another secret")
+	}
+}
+
+func TestFakeCompleteUnknownCheckoutSession(t *testing.T) {
+	f := NewFake(testWebhookSecret)
+	if _, _, err := f.CompleteCheckoutSession("cs_missing"); err != ErrFakeNotFound {
+		t.Errorf("CompleteCheckoutSession error = %v, want ErrFakeNotFound", err)
+	}
+}
+
+func TestFakeCheckoutSessionLineItems(t *testing.T) {
+	f := NewFake(testWebhookSecret)
+	f.AddPrice("price_short", "usd", 1000)
+	f.AddPrice("price_long", "usd", 3000)
+	f.AddCoupon(&stripe.Coupon{ID: "coupon_cart", AmountOff: 1000, Currency: "usd", Valid: true})
+
+	created, err := f.CreateCheckoutSession(&stripe.CheckoutSessionParams{
+		Mode:     stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer: stripe.String("cus_test"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String("price_short"), Quantity: stripe.Int64(1)},
+			{Price: stripe.String("price_long"), Quantity: stripe.Int64(1)},
+		},
+		Discounts: []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String("coupon_cart")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckoutSession: %v", err)
+	}
+	if _, _, err := f.CompleteCheckoutSession(created.ID); err != nil {
+		t.Fatalf("CompleteCheckoutSession: %v", err)
+	}
+
+	lineItems, err := f.ListCheckoutSessionLineItems(created.ID)
+	if err != nil {
+		t.Fatalf("ListCheckoutSessionLineItems: %v", err)
+	}
+	if len(lineItems) != 2 {
+		t.Fatalf("got %d line items, want 2", len(lineItems))
+	}
+	// The discount follows each line's share of the subtotal
+	if lineItems[0].AmountTotal != 750 || lineItems[0].AmountDiscount != 250 {
+		t.Errorf("first line = %d/%d, want 750/250", lineItems[0].AmountTotal, lineItems[0].AmountDiscount)
+	}
+	if lineItems[1].AmountTotal != 2250 || lineItems[1].AmountDiscount != 750 {
+		t.Errorf("second line = %d/%d, want 2250/750", lineItems[1].AmountTotal, lineItems[1].AmountDiscount)
+	}
+}
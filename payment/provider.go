@@ -0,0 +1,43 @@
+package payment
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Provider is everything the application asks of the payment processor.
+// Stripe types are used as the common data model so that the Stripe
+// implementation is a thin pass-through.
+type Provider interface {
+	CreateCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string) (*stripe.Customer, error)
+
+	CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	CreateBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
+	// ListCheckoutSessionLineItems lists a session's line items in the order
+	// they were passed to CreateCheckoutSession, with what each one was paid.
+	ListCheckoutSessionLineItems(sessionId string) ([]*stripe.LineItem, error)
+
+	GetSubscription(id string) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string) (*stripe.Subscription, error)
+
+	GetPrice(id string) (*stripe.Price, error)
+	GetCoupon(id string) (*stripe.Coupon, error)
+	// FindPromotionCode returns the active promotion code with the given
+	// customer-facing code, or nil when there is none.
+	FindPromotionCode(code string) (*stripe.PromotionCode, error)
+
+	ListInvoices(customerId string, limit int) ([]*stripe.Invoice, error)
+	ListPaymentIntents(customerId string, limit int) ([]*stripe.PaymentIntent, error)
+
+	// The full listings below walk every page and are meant for batch jobs.
+	ListCustomers() ([]*stripe.Customer, error)
+	ListSubscriptions() ([]*stripe.Subscription, error)
+	// ListCheckoutSessions lists the sessions created after createdAfter.
+	ListCheckoutSessions(createdAfter time.Time) ([]*stripe.CheckoutSession, error)
+
+	// ConstructEvent verifies a webhook signature and parses the event.
+	ConstructEvent(payload []byte, signature string) (stripe.Event, error)
+}
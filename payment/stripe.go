@@ -0,0 +1,164 @@
+package payment
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	portalsession "github.com/stripe/stripe-go/v74/billingportal/session"
+	"github.com/stripe/stripe-go/v74/checkout/session"
+	"github.com/stripe/stripe-go/v74/coupon"
+	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/invoice"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+	"github.com/stripe/stripe-go/v74/price"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	"github.com/stripe/stripe-go/v74/subscription"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+type StripeProvider struct {
+	webhookSecret string
+}
+
+func NewStripeProvider(secretKey string, webhookSecret string) *StripeProvider {
+	stripe.Key = secretKey
+	return &StripeProvider{webhookSecret: webhookSecret}
+}
+
+func (p *StripeProvider) CreateCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return customer.New(params)
+}
+
+func (p *StripeProvider) GetCustomer(id string) (*stripe.Customer, error) {
+	return customer.Get(id, nil)
+}
+
+func (p *StripeProvider) CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return session.New(params)
+}
+
+func (p *StripeProvider) CreateBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	return portalsession.New(params)
+}
+
+func (p *StripeProvider) ListCheckoutSessionLineItems(sessionId string) ([]*stripe.LineItem, error) {
+	params := &stripe.CheckoutSessionListLineItemsParams{Session: stripe.String(sessionId)}
+	params.Limit = stripe.Int64(100)
+
+	lineItems := []*stripe.LineItem{}
+	i := session.ListLineItems(params)
+	for i.Next() {
+		lineItems = append(lineItems, i.LineItem())
+	}
+	return lineItems, i.Err()
+}
+
+func (p *StripeProvider) GetSubscription(id string) (*stripe.Subscription, error) {
+	return subscription.Get(id, nil)
+}
+
+func (p *StripeProvider) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return subscription.Update(id, params)
+}
+
+func (p *StripeProvider) CancelSubscription(id string) (*stripe.Subscription, error) {
+	return subscription.Cancel(id, nil)
+}
+
+func (p *StripeProvider) GetPrice(id string) (*stripe.Price, error) {
+	return price.Get(id, nil)
+}
+
+func (p *StripeProvider) GetCoupon(id string) (*stripe.Coupon, error) {
+	return coupon.Get(id, nil)
+}
+
+func (p *StripeProvider) FindPromotionCode(code string) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	}
+	params.Limit = stripe.Int64(1)
+
+	i := promotioncode.List(params)
+	if i.Next() {
+		return i.PromotionCode(), nil
+	}
+	return nil, i.Err()
+}
+
+func (p *StripeProvider) ListInvoices(customerId string, limit int) ([]*stripe.Invoice, error) {
+	params := &stripe.InvoiceListParams{
+		Customer: stripe.String(customerId),
+	}
+	params.Limit = stripe.Int64(int64(limit))
+
+	invoices := []*stripe.Invoice{}
+	i := invoice.List(params)
+	for len(invoices) < limit && i.Next() {
+		invoices = append(invoices, i.Invoice())
+	}
+	return invoices, i.Err()
+}
+
+func (p *StripeProvider) ListPaymentIntents(customerId string, limit int) ([]*stripe.PaymentIntent, error) {
+	params := &stripe.PaymentIntentListParams{
+		Customer: stripe.String(customerId),
+	}
+	params.Limit = stripe.Int64(int64(limit))
+	params.AddExpand("data.latest_charge")
+
+	paymentIntents := []*stripe.PaymentIntent{}
+	i := paymentintent.List(params)
+	for len(paymentIntents) < limit && i.Next() {
+		paymentIntents = append(paymentIntents, i.PaymentIntent())
+	}
+	return paymentIntents, i.Err()
+}
+
+func (p *StripeProvider) ListCustomers() ([]*stripe.Customer, error) {
+	params := &stripe.CustomerListParams{}
+	params.Limit = stripe.Int64(100)
+
+	customers := []*stripe.Customer{}
+	i := customer.List(params)
+	for i.Next() {
+		customers = append(customers, i.Customer())
+	}
+	return customers, i.Err()
+}
+
+func (p *StripeProvider) ListSubscriptions() ([]*stripe.Subscription, error) {
+	params := &stripe.SubscriptionListParams{
+		Status: stripe.String("all"),
+	}
+	params.Limit = stripe.Int64(100)
+
+	subscriptions := []*stripe.Subscription{}
+	i := subscription.List(params)
+	for i.Next() {
+		subscriptions = append(subscriptions, i.Subscription())
+	}
+	return subscriptions, i.Err()
+}
+
+func (p *StripeProvider) ListCheckoutSessions(createdAfter time.Time) ([]*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionListParams{}
+	params.Limit = stripe.Int64(100)
+
+	// Sessions are listed newest first
+	sessions := []*stripe.CheckoutSession{}
+	i := session.List(params)
+	for i.Next() {
+		s := i.CheckoutSession()
+		if s.Created < createdAfter.Unix() {
+			break
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, i.Err()
+}
+
+func (p *StripeProvider) ConstructEvent(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, p.webhookSecret)
+}
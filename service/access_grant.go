@@ -0,0 +1,36 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+func GrantCourseAccess(userId uuid.UUID, courseId uuid.UUID, source string, note string, expiresAt *time.Time) (*models.AccessGrant, error) {
+	if database.GetCourse(courseId) == nil {
+		return nil, errors.New("course not found")
+	}
+
+	grant := models.AccessGrant{
+		UserID:    lib.NewUUID(userId),
+		CourseID:  lib.NewUUID(courseId),
+		Source:    source,
+		Note:      note,
+		ExpiresAt: expiresAt,
+	}
+	if err := database.DB.Create(&grant).Error; err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func RevokeCourseAccess(userId uuid.UUID, courseId uuid.UUID, source string) error {
+	return database.DB.Model(&models.AccessGrant{}).
+		Where("user_id = ? AND course_id = ? AND source = ? AND revoked_at IS NULL", userId, courseId, source).
+		Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,505 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	MetricCoursesCompleted  = "courses_completed"
+	MetricContentsCompleted = "contents_completed"
+	MetricLongestStreak     = "longest_streak"
+	MetricPerfectChapters   = "perfect_chapters"
+)
+
+// Scores are percentages, so a perfect attempt scores 100.
+const perfectScore = 100.0
+
+// AchievementRule is met once the user's value for Metric reaches Threshold.
+// ContentType narrows MetricContentsCompleted to one type of content.
+type AchievementRule struct {
+	Metric      string `json:"metric"`
+	ContentType string `json:"contentType,omitempty"`
+	Threshold   int    `json:"threshold"`
+}
+
+type Achievement struct {
+	Id          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	XP          int             `json:"xp"`
+	Rule        AchievementRule `json:"rule"`
+}
+
+// Achievements are matched by Id once earned, so an Id must never change.
+var Achievements = []Achievement{
+	{Id: "first_content", Name: "First Move", Description: "Complete your first lesson, puzzle or quiz", XP: 10, Rule: AchievementRule{Metric: MetricContentsCompleted, Threshold: 1}},
+	{Id: "first_course", Name: "Graduate", Description: "Complete a whole course", XP: 200, Rule: AchievementRule{Metric: MetricCoursesCompleted, Threshold: 1}},
+	{Id: "five_courses", Name: "Scholar", Description: "Complete five courses", XP: 500, Rule: AchievementRule{Metric: MetricCoursesCompleted, Threshold: 5}},
+	{Id: "puzzles_100", Name: "Tactician", Description: "Solve 100 puzzles", XP: 300, Rule: AchievementRule{Metric: MetricContentsCompleted, ContentType: models.ContentTypePuzzle, Threshold: 100}},
+	{Id: "streak_7", Name: "On a Roll", Description: "Keep a 7-day streak", XP: 70, Rule: AchievementRule{Metric: MetricLongestStreak, Threshold: 7}},
+	{Id: "streak_30", Name: "Unstoppable", Description: "Keep a 30-day streak", XP: 300, Rule: AchievementRule{Metric: MetricLongestStreak, Threshold: 30}},
+	{Id: "perfect_chapter", Name: "Flawless", Description: "Finish a chapter with a perfect score on every puzzle and quiz", XP: 100, Rule: AchievementRule{Metric: MetricPerfectChapters, Threshold: 1}},
+}
+
+var xpPerContentType = map[string]int{
+	models.ContentTypeLesson: 10,
+	models.ContentTypeVideo:  10,
+	models.ContentTypePuzzle: 5,
+	models.ContentTypeQuiz:   20,
+}
+
+type EarnedAchievement struct {
+	Achievement
+	EarnedAt time.Time `json:"earnedAt"`
+}
+
+type AvailableAchievement struct {
+	Achievement
+	Progress int `json:"progress"`
+}
+
+type AchievementSummary struct {
+	XP          int                    `json:"xp"`
+	Level       int                    `json:"level"`
+	LevelXP     int                    `json:"levelXp"`
+	NextLevelXP int                    `json:"nextLevelXp"`
+	Earned      []EarnedAchievement    `json:"earned"`
+	Available   []AvailableAchievement `json:"available"`
+}
+
+// achievementFacts are the values the rules are checked against.
+type achievementFacts struct {
+	coursesCompleted  int
+	contentsCompleted map[string]int
+	longestStreak     int
+	perfectChapters   int
+}
+
+func (facts achievementFacts) value(rule AchievementRule) int {
+	switch rule.Metric {
+	case MetricCoursesCompleted:
+		return facts.coursesCompleted
+	case MetricContentsCompleted:
+		if rule.ContentType != "" {
+			return facts.contentsCompleted[rule.ContentType]
+		}
+		total := 0
+		for _, count := range facts.contentsCompleted {
+			total += count
+		}
+		return total
+	case MetricLongestStreak:
+		return facts.longestStreak
+	case MetricPerfectChapters:
+		return facts.perfectChapters
+	}
+	return 0
+}
+
+func contentType(content models.Content) string {
+	if content.Type == "" {
+		return models.ContentTypeLesson
+	}
+	return content.Type
+}
+
+// LevelForXP returns the level reached with xp, and the XP at which that
+// level and the next one start. Reaching level n takes 50·n·(n−1) XP: 100
+// for level 2, 300 for level 3 and so on.
+func LevelForXP(xp int) (int, int, int) {
+	level := 1
+	for 50*(level+1)*level <= xp {
+		level++
+	}
+	return level, 50 * level * (level - 1), 50 * (level + 1) * level
+}
+
+// RewardProgress pays out the XP for progress on a piece of content and
+// awards the achievements that progress can have earned. Both are
+// idempotent, so it is safe to run after every progress event. It returns
+// the achievements earned by this call.
+func RewardProgress(userId uuid.UUID, contentId uuid.UUID) ([]Achievement, error) {
+	var user models.AppUser
+	if err := database.DB.Preload("Membership").Where("id = ?", userId).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	var earned []Achievement
+	var awarded []models.XPEvent
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		metrics, contentXP, err := rewardContent(tx, &user, contentId)
+		if err != nil {
+			return err
+		}
+		// Every progress event counts towards the day's activity
+		metrics[MetricLongestStreak] = true
+
+		facts, err := loadAchievementFacts(tx, &user, metrics, false)
+		if err != nil {
+			return err
+		}
+		var achievementXP []models.XPEvent
+		earned, achievementXP, err = awardAchievements(tx, &user, facts, metrics)
+		awarded = append(contentXP, achievementXP...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordXPOnLeaderboards(userId, awarded)
+	return earned, nil
+}
+
+// rewardContent pays out the XP for the content if it is completed, and
+// records the course and perfect chapter milestones it completes. It
+// returns the metrics that changed and the XP paid.
+func rewardContent(tx *gorm.DB, user *models.AppUser, contentId uuid.UUID) (map[string]bool, []models.XPEvent, error) {
+	metrics := map[string]bool{}
+	coursePtr, chapterPtr, contentPtr := database.GetCourseAndChapterAndContent(contentId)
+	if contentPtr == nil {
+		return metrics, nil, nil
+	}
+
+	contentIds := []uuid.UUID{}
+	for _, chapter := range coursePtr.Chapters {
+		for _, content := range chapter.Contents {
+			contentIds = append(contentIds, content.Id.Bytes)
+		}
+	}
+	var rows []models.ContentProgress
+	if err := tx.Where("user_id = ? AND content_id IN ?", user.Id, contentIds).Find(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+	progress := make(map[uuid.UUID]models.ContentProgress, len(rows))
+	completed := make(map[uuid.UUID]bool, len(rows))
+	for _, row := range rows {
+		progress[row.ContentID.Bytes] = row
+		completed[row.ContentID.Bytes] = row.Status == models.ContentProgressStatusCompleted
+	}
+	if !completed[contentId] {
+		return metrics, nil, nil
+	}
+
+	awarded := []models.XPEvent{}
+	event := models.XPEvent{
+		UserID:      user.Id,
+		Source:      models.XPSourceContent,
+		SourceID:    uuidString(contentId),
+		ContentType: contentType(*contentPtr),
+		Amount:      xpPerContentType[contentType(*contentPtr)],
+	}
+	paid, err := createXPEvent(tx, &event)
+	if err != nil {
+		return nil, nil, err
+	}
+	if paid {
+		awarded = append(awarded, event)
+		metrics[MetricContentsCompleted] = true
+	}
+
+	if courseCompleted(completed, coursePtr) {
+		milestone := models.XPEvent{UserID: user.Id, Source: models.XPSourceCourse, SourceID: uuidString(coursePtr.Id.Bytes)}
+		recorded, err := createXPEvent(tx, &milestone)
+		if err != nil {
+			return nil, nil, err
+		}
+		metrics[MetricCoursesCompleted] = recorded
+	}
+	if chapterPerfect(chapterPtr, progress) {
+		milestone := models.XPEvent{UserID: user.Id, Source: models.XPSourcePerfectChapter, SourceID: uuidString(chapterPtr.Id.Bytes)}
+		recorded, err := createXPEvent(tx, &milestone)
+		if err != nil {
+			return nil, nil, err
+		}
+		metrics[MetricPerfectChapters] = recorded
+	}
+	return metrics, awarded, nil
+}
+
+// chapterPerfect reports whether every piece of content in the chapter is
+// completed and every scored one has a perfect score.
+func chapterPerfect(chapter *models.Chapter, progress map[uuid.UUID]models.ContentProgress) bool {
+	scored := false
+	for _, content := range chapter.Contents {
+		row, started := progress[content.Id.Bytes]
+		if !started || row.Status != models.ContentProgressStatusCompleted {
+			return false
+		}
+		if row.Score != nil {
+			if *row.Score < perfectScore {
+				return false
+			}
+			scored = true
+		}
+	}
+	return scored
+}
+
+// createXPEvent adds the event to the ledger unless its source already
+// paid out, and reports whether it did.
+func createXPEvent(tx *gorm.DB, event *models.XPEvent) (bool, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	return result.RowsAffected == 1, result.Error
+}
+
+// awardAchievements awards the achievements on the given metrics whose rule
+// is now met, with their XP.
+func awardAchievements(tx *gorm.DB, user *models.AppUser, facts achievementFacts, metrics map[string]bool) ([]Achievement, []models.XPEvent, error) {
+	earned := []Achievement{}
+	awarded := []models.XPEvent{}
+	for _, achievement := range Achievements {
+		if !metrics[achievement.Rule.Metric] || facts.value(achievement.Rule) < achievement.Rule.Threshold {
+			continue
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserAchievement{
+			UserID:        user.Id,
+			AchievementID: achievement.Id,
+			EarnedAt:      time.Now(),
+		})
+		if result.Error != nil {
+			return nil, nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		event := models.XPEvent{
+			UserID:   user.Id,
+			Source:   models.XPSourceAchievement,
+			SourceID: achievement.Id,
+			Amount:   achievement.XP,
+		}
+		paid, err := createXPEvent(tx, &event)
+		if err != nil {
+			return nil, nil, err
+		}
+		if paid {
+			awarded = append(awarded, event)
+		}
+		earned = append(earned, achievement)
+	}
+	return earned, awarded, nil
+}
+
+// loadAchievementFacts works out the values of the given metrics from the
+// ledger. Events only look for the longest streak in the last few weeks of
+// activity, which holds any streak that ended since the previous event;
+// fullHistory looks through all of it.
+func loadAchievementFacts(db *gorm.DB, user *models.AppUser, metrics map[string]bool, fullHistory bool) (achievementFacts, error) {
+	facts := achievementFacts{contentsCompleted: map[string]int{}}
+
+	if metrics[MetricContentsCompleted] || metrics[MetricCoursesCompleted] || metrics[MetricPerfectChapters] {
+		var counts []struct {
+			Source      string
+			ContentType string
+			Count       int
+		}
+		err := db.Model(&models.XPEvent{}).
+			Select("source, content_type, COUNT(*) AS count").
+			Where("user_id = ? AND source IN ?", user.Id, []string{models.XPSourceContent, models.XPSourceCourse, models.XPSourcePerfectChapter}).
+			Group("source, content_type").
+			Scan(&counts).Error
+		if err != nil {
+			return facts, err
+		}
+		for _, count := range counts {
+			switch count.Source {
+			case models.XPSourceContent:
+				facts.contentsCompleted[count.ContentType] += count.Count
+			case models.XPSourceCourse:
+				facts.coursesCompleted += count.Count
+			case models.XPSourcePerfectChapter:
+				facts.perfectChapters += count.Count
+			}
+		}
+	}
+
+	if metrics[MetricLongestStreak] {
+		since := time.Time{}
+		if !fullHistory {
+			since = time.Now().AddDate(0, 0, -streakWindowDays())
+		}
+		days, err := loadStreakDays(user, since)
+		if err != nil {
+			return facts, err
+		}
+		facts.longestStreak = longestStreak(days.met, days.frozen)
+	}
+	return facts, nil
+}
+
+// rewardStreak awards the streak achievements the user's activity has
+// earned. Time spent alone can meet the daily goal, so this runs when
+// heartbeats are recorded as well as with every progress event.
+func rewardStreak(userId uuid.UUID) error {
+	var user models.AppUser
+	if err := database.DB.Preload("Membership").Where("id = ?", userId).First(&user).Error; err != nil {
+		return err
+	}
+
+	metrics := map[string]bool{MetricLongestStreak: true}
+	var awarded []models.XPEvent
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		facts, err := loadAchievementFacts(tx, &user, metrics, false)
+		if err != nil {
+			return err
+		}
+		_, awarded, err = awardAchievements(tx, &user, facts, metrics)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	recordXPOnLeaderboards(userId, awarded)
+	return nil
+}
+
+// streakWindowDays is how far back a streak that reaches the longest streak
+// threshold can start, allowing for a frozen day for every met one.
+func streakWindowDays() int {
+	longest := 0
+	for _, achievement := range Achievements {
+		if achievement.Rule.Metric == MetricLongestStreak && achievement.Rule.Threshold > longest {
+			longest = achievement.Rule.Threshold
+		}
+	}
+	return 2 * longest
+}
+
+// BackfillRewards pays out the rewards for progress made before rewards
+// were paid per event, in the background. Users are picked up while they
+// have completed content without XP, or XP from before content types were
+// recorded.
+func BackfillRewards() {
+	go func() {
+		var userIds []lib.UUID
+		err := database.DB.Raw(`
+			SELECT DISTINCT content_progress.user_id FROM content_progress
+			WHERE content_progress.status = ? AND NOT EXISTS (
+				SELECT 1 FROM xp_events
+				WHERE xp_events.user_id = content_progress.user_id
+				AND xp_events.source = ?
+				AND xp_events.source_id = content_progress.content_id::text
+			)
+			UNION
+			SELECT DISTINCT user_id FROM xp_events WHERE source = ? AND content_type = ''
+		`, models.ContentProgressStatusCompleted, models.XPSourceContent, models.XPSourceContent).Scan(&userIds).Error
+		if err != nil {
+			log.Printf("reward backfill failed: %v", err)
+			return
+		}
+		for _, userId := range userIds {
+			if err := backfillUserRewards(userId.Bytes); err != nil {
+				log.Printf("reward backfill for %s failed: %v", uuidString(userId.Bytes), err)
+			}
+		}
+	}()
+}
+
+func backfillUserRewards(userId uuid.UUID) error {
+	var user models.AppUser
+	if err := database.DB.Preload("Membership").Where("id = ?", userId).First(&user).Error; err != nil {
+		return err
+	}
+	var rows []models.ContentProgress
+	if err := database.DB.Where("user_id = ? AND status = ?", user.Id, models.ContentProgressStatusCompleted).Find(&rows).Error; err != nil {
+		return err
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var untyped []models.XPEvent
+		if err := tx.Where("user_id = ? AND source = ? AND content_type = ''", user.Id, models.XPSourceContent).Find(&untyped).Error; err != nil {
+			return err
+		}
+		for _, event := range untyped {
+			// Content no longer in the catalog counts as a lesson
+			eventType := models.ContentTypeLesson
+			if contentId, err := uuid.Parse(event.SourceID); err == nil {
+				if _, _, contentPtr := database.GetCourseAndChapterAndContent(contentId); contentPtr != nil {
+					eventType = contentType(*contentPtr)
+				}
+			}
+			if err := tx.Model(&event).Update("content_type", eventType).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, row := range rows {
+			if _, _, err := rewardContent(tx, &user, row.ContentID.Bytes); err != nil {
+				return err
+			}
+		}
+
+		facts, err := loadAchievementFacts(tx, &user, allAchievementMetrics, true)
+		if err != nil {
+			return err
+		}
+		_, _, err = awardAchievements(tx, &user, facts, allAchievementMetrics)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sets the user's scores outright, so XP paid here is not counted twice
+	// if the boards are also being rebuilt
+	return rebuildUserLeaderboards(&user)
+}
+
+// allAchievementMetrics is every metric a rule can use.
+var allAchievementMetrics = map[string]bool{
+	MetricCoursesCompleted:  true,
+	MetricContentsCompleted: true,
+	MetricLongestStreak:     true,
+	MetricPerfectChapters:   true,
+}
+
+func GetAchievementSummary(user *models.AppUser) (*AchievementSummary, error) {
+	facts, err := loadAchievementFacts(database.DB, user, allAchievementMetrics, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var xp int
+	if err := database.DB.Model(&models.XPEvent{}).Where("user_id = ?", user.Id).Select("COALESCE(SUM(amount), 0)").Scan(&xp).Error; err != nil {
+		return nil, err
+	}
+	var userAchievements []models.UserAchievement
+	if err := database.DB.Where("user_id = ?", user.Id).Find(&userAchievements).Error; err != nil {
+		return nil, err
+	}
+	earnedAt := make(map[string]time.Time, len(userAchievements))
+	for _, userAchievement := range userAchievements {
+		earnedAt[userAchievement.AchievementID] = userAchievement.EarnedAt
+	}
+
+	summary := &AchievementSummary{
+		XP:        xp,
+		Earned:    []EarnedAchievement{},
+		Available: []AvailableAchievement{},
+	}
+	summary.Level, summary.LevelXP, summary.NextLevelXP = LevelForXP(xp)
+
+	for _, achievement := range Achievements {
+		if at, ok := earnedAt[achievement.Id]; ok {
+			summary.Earned = append(summary.Earned, EarnedAchievement{Achievement: achievement, EarnedAt: at})
+			continue
+		}
+		summary.Available = append(summary.Available, AvailableAchievement{
+			Achievement: achievement,
+			Progress:    facts.value(achievement.Rule),
+		})
+	}
+	return summary, nil
+}
@@ -0,0 +1,23 @@
+package service
+
+import "testing"
+
+func TestLevelForXP(t *testing.T) {
+	tests := []struct {
+		xp                      int
+		level, start, nextStart int
+	}{
+		{0, 1, 0, 100},
+		{99, 1, 0, 100},
+		{100, 2, 100, 300},
+		{299, 2, 100, 300},
+		{300, 3, 300, 600},
+		{1000, 5, 1000, 1500},
+	}
+	for _, tt := range tests {
+		level, start, nextStart := LevelForXP(tt.xp)
+		if level != tt.level || start != tt.start || nextStart != tt.nextStart {
+			t.Errorf("LevelForXP(%d) = %d, %d, %d, want %d, %d, %d", tt.xp, level, start, nextStart, tt.level, tt.start, tt.nextStart)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+	// Timezones are validated in Go, so do not rely on the host having tzdata
+	_ "time/tzdata"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	streakFreezesPerMonth = 2
+	activityHeatmapDays   = 365
+	maxDailyGoalContents  = 100
+	maxDailyGoalMinutes   = 600
+)
+
+var (
+	ErrInvalidTimezone  = errors.New("invalid timezone")
+	ErrInvalidDailyGoal = errors.New("invalid daily goal")
+)
+
+type ActivityDay struct {
+	Date              string `json:"date"`
+	CompletedContents int    `json:"completedContents"`
+	Attempts          int    `json:"attempts"`
+	Minutes           int64  `json:"minutes"`
+	GoalMet           bool   `json:"goalMet"`
+	Frozen            bool   `json:"frozen"`
+}
+
+// ActivityStats holds a year of daily activity, oldest first. Days without
+// any activity or freeze are left out.
+type ActivityStats struct {
+	Timezone          string        `json:"timezone"`
+	DailyGoalContents int           `json:"dailyGoalContents"`
+	DailyGoalMinutes  int           `json:"dailyGoalMinutes"`
+	Today             ActivityDay   `json:"today"`
+	CurrentStreak     int           `json:"currentStreak"`
+	LongestStreak     int           `json:"longestStreak"`
+	FreezesAvailable  int           `json:"freezesAvailable"`
+	From              string        `json:"from"`
+	To                string        `json:"to"`
+	Days              []ActivityDay `json:"days"`
+}
+
+type ActivitySettings struct {
+	Timezone          *string `json:"timezone"`
+	DailyGoalContents *int    `json:"dailyGoalContents"`
+	DailyGoalMinutes  *int    `json:"dailyGoalMinutes"`
+}
+
+// recordDailyActivity adds to the user's activity for the current day in
+// their timezone.
+func recordDailyActivity(tx *gorm.DB, userId uuid.UUID, completedContents int, attempts int, seconds int64) error {
+	return tx.Exec(`
+		INSERT INTO daily_activities (user_id, day, completed_contents, attempts, seconds)
+		SELECT id, (now() AT TIME ZONE COALESCE(NULLIF(timezone, ''), 'UTC'))::date, ?, ?, ?
+		FROM app_users WHERE id = ?
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			completed_contents = daily_activities.completed_contents + excluded.completed_contents,
+			attempts = daily_activities.attempts + excluded.attempts,
+			seconds = daily_activities.seconds + excluded.seconds
+	`, completedContents, attempts, seconds, userId).Error
+}
+
+func UpdateActivitySettings(user *models.AppUser, settings ActivitySettings) error {
+	updates := map[string]interface{}{}
+	if settings.Timezone != nil {
+		if _, err := time.LoadLocation(*settings.Timezone); err != nil || *settings.Timezone == "" || *settings.Timezone == "Local" {
+			return ErrInvalidTimezone
+		}
+		updates["timezone"] = *settings.Timezone
+	}
+	if settings.DailyGoalContents != nil {
+		if *settings.DailyGoalContents < 0 || *settings.DailyGoalContents > maxDailyGoalContents {
+			return ErrInvalidDailyGoal
+		}
+		updates["daily_goal_contents"] = *settings.DailyGoalContents
+	}
+	if settings.DailyGoalMinutes != nil {
+		if *settings.DailyGoalMinutes < 0 || *settings.DailyGoalMinutes > maxDailyGoalMinutes {
+			return ErrInvalidDailyGoal
+		}
+		updates["daily_goal_minutes"] = *settings.DailyGoalMinutes
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return database.DB.Model(&models.AppUser{}).Where("id = ?", user.Id).Updates(updates).Error
+}
+
+func userLocation(user *models.AppUser) *time.Location {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil || user.Timezone == "" {
+		return time.UTC
+	}
+	return location
+}
+
+// activityDate is the calendar day of t in location, as midnight UTC to
+// match how date columns are read back.
+func activityDate(t time.Time, location *time.Location) time.Time {
+	year, month, day := t.In(location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// goalMet reports whether the day counts towards the streak. Without a
+// goal, one completion or attempt is enough.
+func goalMet(user *models.AppUser, activity models.DailyActivity) bool {
+	if user.DailyGoalContents == 0 && user.DailyGoalMinutes == 0 {
+		return activity.CompletedContents+activity.Attempts > 0
+	}
+	return activity.CompletedContents >= user.DailyGoalContents &&
+		activity.Seconds >= int64(user.DailyGoalMinutes)*60
+}
+
+// streakDays is a user's activity keyed by day, with the days that met
+// their goal and the days a freeze covered. Frozen includes the planned
+// freezes that have not been spent yet.
+type streakDays struct {
+	today   time.Time
+	byDay   map[time.Time]models.DailyActivity
+	met     map[time.Time]bool
+	frozen  map[time.Time]bool
+	planned []time.Time
+}
+
+// loadStreakDays loads the user's activity from since on, or all of it when
+// since is zero. Freezes are loaded from the start of since's month so that
+// the ones left in it are known.
+func loadStreakDays(user *models.AppUser, since time.Time) (*streakDays, error) {
+	var activities []models.DailyActivity
+	if err := database.DB.Where("user_id = ? AND day >= ?", user.Id, since).Find(&activities).Error; err != nil {
+		return nil, err
+	}
+	var freezes []models.StreakFreeze
+	if err := database.DB.Where("user_id = ? AND day >= ?", user.Id, monthOf(since)).Find(&freezes).Error; err != nil {
+		return nil, err
+	}
+
+	days := &streakDays{
+		today:  activityDate(time.Now(), userLocation(user)),
+		byDay:  make(map[time.Time]models.DailyActivity, len(activities)),
+		met:    map[time.Time]bool{},
+		frozen: map[time.Time]bool{},
+	}
+	for _, activity := range activities {
+		day := activity.Day.UTC()
+		days.byDay[day] = activity
+		days.met[day] = goalMet(user, activity)
+	}
+	for _, freeze := range freezes {
+		days.frozen[freeze.Day.UTC()] = true
+	}
+
+	if entitlement.HasActiveMembership(user) {
+		days.planned = planStreakFreezes(days.today, days.met, days.frozen)
+	}
+	return days, nil
+}
+
+// spendStreakFreezes stores the freezes a member's streak needs, so that
+// later gaps cannot take them back. It runs after activity is recorded;
+// until then reads show the same freezes as planned.
+func spendStreakFreezes(userId uuid.UUID) {
+	var user models.AppUser
+	if err := database.DB.Preload("Membership").Where("id = ?", userId).First(&user).Error; err != nil {
+		log.Printf("spending streak freezes for %s failed: %v", userId, err)
+		return
+	}
+	days, err := loadStreakDays(&user, time.Time{})
+	if err != nil {
+		log.Printf("spending streak freezes for %s failed: %v", userId, err)
+		return
+	}
+	if len(days.planned) == 0 {
+		return
+	}
+
+	freezes := make([]models.StreakFreeze, len(days.planned))
+	for i, day := range days.planned {
+		freezes[i] = models.StreakFreeze{UserID: user.Id, Day: day}
+	}
+	if err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&freezes).Error; err != nil {
+		log.Printf("spending streak freezes for %s failed: %v", userId, err)
+	}
+}
+
+func GetActivityStats(user *models.AppUser) (*ActivityStats, error) {
+	days, err := loadStreakDays(user, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	today, byDay, met, frozen := days.today, days.byDay, days.met, days.frozen
+
+	stats := &ActivityStats{
+		Timezone:          userLocation(user).String(),
+		DailyGoalContents: user.DailyGoalContents,
+		DailyGoalMinutes:  user.DailyGoalMinutes,
+		Today:             activityDay(today, byDay[today], met[today], frozen[today]),
+		CurrentStreak:     currentStreak(today, met, frozen),
+		LongestStreak:     longestStreak(met, frozen),
+		FreezesAvailable:  streakFreezesPerMonth - freezesInMonth(today, frozen),
+		From:              today.AddDate(0, 0, 1-activityHeatmapDays).Format("2006-01-02"),
+		To:                today.Format("2006-01-02"),
+		Days:              []ActivityDay{},
+	}
+	if !entitlement.HasActiveMembership(user) {
+		stats.FreezesAvailable = 0
+	}
+
+	for day := today.AddDate(0, 0, 1-activityHeatmapDays); !day.After(today); day = day.AddDate(0, 0, 1) {
+		activity, active := byDay[day]
+		if active || frozen[day] {
+			stats.Days = append(stats.Days, activityDay(day, activity, met[day], frozen[day]))
+		}
+	}
+	return stats, nil
+}
+
+func activityDay(day time.Time, activity models.DailyActivity, goalMet bool, frozen bool) ActivityDay {
+	return ActivityDay{
+		Date:              day.Format("2006-01-02"),
+		CompletedContents: activity.CompletedContents,
+		Attempts:          activity.Attempts,
+		Minutes:           activity.Seconds / 60,
+		GoalMet:           goalMet,
+		Frozen:            frozen,
+	}
+}
+
+// planStreakFreezes marks a member's freezes on the days missed within
+// their streak, newest gap first, and stops at the first gap the freezes
+// left in its month cannot cover. Today is still in progress and is never
+// frozen. It returns the days it froze.
+func planStreakFreezes(today time.Time, met map[time.Time]bool, frozen map[time.Time]bool) []time.Time {
+	earliest := today
+	for day := range met {
+		if met[day] && day.Before(earliest) {
+			earliest = day
+		}
+	}
+
+	planned := []time.Time{}
+	day := today.AddDate(0, 0, -1)
+	for day.After(earliest) {
+		if met[day] || frozen[day] {
+			day = day.AddDate(0, 0, -1)
+			continue
+		}
+
+		gap := []time.Time{}
+		for !met[day] && !frozen[day] && day.After(earliest) {
+			gap = append(gap, day)
+			day = day.AddDate(0, 0, -1)
+		}
+		if !met[day] && !frozen[day] {
+			break
+		}
+
+		needed := map[time.Time]int{}
+		for _, gapDay := range gap {
+			needed[monthOf(gapDay)]++
+		}
+		covered := true
+		for month, count := range needed {
+			if freezesInMonth(month, frozen)+count > streakFreezesPerMonth {
+				covered = false
+			}
+		}
+		if !covered {
+			break
+		}
+
+		for _, gapDay := range gap {
+			frozen[gapDay] = true
+			planned = append(planned, gapDay)
+		}
+	}
+	return planned
+}
+
+func monthOf(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func freezesInMonth(day time.Time, frozen map[time.Time]bool) int {
+	count := 0
+	for frozenDay := range frozen {
+		if monthOf(frozenDay).Equal(monthOf(day)) {
+			count++
+		}
+	}
+	return count
+}
+
+// currentStreak counts the goal days in the run ending today, or yesterday
+// while today's goal is still open. Frozen days keep a streak alive without
+// adding to it.
+func currentStreak(today time.Time, met map[time.Time]bool, frozen map[time.Time]bool) int {
+	day := today
+	if !met[day] && !frozen[day] {
+		day = day.AddDate(0, 0, -1)
+	}
+
+	streak := 0
+	for met[day] || frozen[day] {
+		if met[day] {
+			streak++
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return streak
+}
+
+func longestStreak(met map[time.Time]bool, frozen map[time.Time]bool) int {
+	days := []time.Time{}
+	for day := range met {
+		if met[day] || frozen[day] {
+			days = append(days, day)
+		}
+	}
+	for day := range frozen {
+		if _, ok := met[day]; !ok {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	longest, streak := 0, 0
+	for i, day := range days {
+		if i > 0 && !days[i-1].AddDate(0, 0, 1).Equal(day) {
+			streak = 0
+		}
+		if met[day] {
+			streak++
+		}
+		if streak > longest {
+			longest = streak
+		}
+	}
+	return longest
+}
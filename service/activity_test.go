@@ -0,0 +1,92 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func day(month time.Month, d int) time.Time {
+	return time.Date(2026, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+// days makes a set of March days, the month most cases are set in.
+func days(ds ...int) map[time.Time]bool {
+	set := map[time.Time]bool{}
+	for _, d := range ds {
+		set[day(time.March, d)] = true
+	}
+	return set
+}
+
+func TestPlanStreakFreezes(t *testing.T) {
+	tests := []struct {
+		name   string
+		today  time.Time
+		met    map[time.Time]bool
+		frozen map[time.Time]bool
+		want   []time.Time
+	}{
+		{"no activity", day(time.March, 20), days(), days(), []time.Time{}},
+		{"no gap", day(time.March, 20), days(17, 18, 19), days(), []time.Time{}},
+		{"one day missed", day(time.March, 20), days(15, 16, 17, 19), days(), []time.Time{day(time.March, 18)}},
+		{"two days missed", day(time.March, 20), days(14, 17, 18, 19), days(), []time.Time{day(time.March, 16), day(time.March, 15)}},
+		{"gap longer than the freezes", day(time.March, 20), days(13, 17, 18, 19), days(), []time.Time{}},
+		{"freezes used up this month", day(time.March, 20), days(17, 19), days(5, 6), []time.Time{}},
+		{"newest gap first", day(time.March, 18), days(12, 14, 16, 17), days(), []time.Time{day(time.March, 15), day(time.March, 13)}},
+		{"gap in the previous month", day(time.April, 2), map[time.Time]bool{day(time.March, 30): true, day(time.April, 1): true}, days(), []time.Time{day(time.March, 31)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planStreakFreezes(tt.today, tt.met, tt.frozen)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planStreakFreezes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCurrentStreak(t *testing.T) {
+	today := day(time.March, 20)
+	tests := []struct {
+		name   string
+		met    map[time.Time]bool
+		frozen map[time.Time]bool
+		want   int
+	}{
+		{"no activity", days(), days(), 0},
+		{"met today", days(18, 19, 20), days(), 3},
+		{"today still open", days(18, 19), days(), 2},
+		{"frozen day in between", days(17, 19), days(18), 2},
+		{"missed yesterday", days(17, 18), days(), 0},
+		{"activity short of the goal", map[time.Time]bool{day(time.March, 18): true, day(time.March, 19): false}, days(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := currentStreak(today, tt.met, tt.frozen); got != tt.want {
+				t.Errorf("currentStreak = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongestStreak(t *testing.T) {
+	tests := []struct {
+		name   string
+		met    map[time.Time]bool
+		frozen map[time.Time]bool
+		want   int
+	}{
+		{"no activity", days(), days(), 0},
+		{"longest run first", days(1, 2, 3, 5, 6), days(), 3},
+		{"frozen day joins two runs", days(1, 2, 4, 5), days(3), 4},
+		{"activity short of the goal", map[time.Time]bool{day(time.March, 1): true, day(time.March, 2): true, day(time.March, 3): false, day(time.March, 4): true}, days(), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := longestStreak(tt.met, tt.frozen); got != tt.want {
+				t.Errorf("longestStreak = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
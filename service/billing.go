@@ -0,0 +1,127 @@
+package service
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+
+	"mehmetfd.dev/chessu-backend/entitlement"
+)
+
+// Billing history is capped; older entries are available in the portal.
+const billingHistoryLimit = 100
+
+type InvoiceSummary struct {
+	Id         string    `json:"id"`
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	AmountDue  int64     `json:"amountDue"`
+	AmountPaid int64     `json:"amountPaid"`
+	Currency   string    `json:"currency"`
+	Created    time.Time `json:"created"`
+	PdfURL     string    `json:"pdfUrl"`
+	HostedURL  string    `json:"hostedUrl"`
+}
+
+type PaymentSummary struct {
+	Id          string    `json:"id"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Amount      int64     `json:"amount"`
+	Currency    string    `json:"currency"`
+	Created     time.Time `json:"created"`
+	ReceiptURL  string    `json:"receiptUrl"`
+}
+
+func CreateBillingPortalLink(userID string) (string, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return "", err
+	}
+
+	customerID, err := GetOrCreateStripeCustomerIDForUser(user.Id.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(frontendURL + "/account"),
+	}
+	portalSession, err := Payments.CreateBillingPortalSession(params)
+	if err != nil {
+		return "", err
+	}
+
+	return portalSession.URL, nil
+}
+
+func ListInvoices(userID string) ([]InvoiceSummary, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := []InvoiceSummary{}
+	if user.StripeId == "" {
+		return invoices, nil
+	}
+
+	stripeInvoices, err := Payments.ListInvoices(user.StripeId, billingHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, inv := range stripeInvoices {
+		invoices = append(invoices, InvoiceSummary{
+			Id:         inv.ID,
+			Number:     inv.Number,
+			Status:     string(inv.Status),
+			AmountDue:  inv.AmountDue,
+			AmountPaid: inv.AmountPaid,
+			Currency:   string(inv.Currency),
+			Created:    time.Unix(inv.Created, 0).UTC(),
+			PdfURL:     inv.InvoicePDF,
+			HostedURL:  inv.HostedInvoiceURL,
+		})
+	}
+
+	return invoices, nil
+}
+
+// ListPayments lists one-off payments such as course purchases. Subscription
+// payments belong to invoices and are left out.
+func ListPayments(userID string) ([]PaymentSummary, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := []PaymentSummary{}
+	if user.StripeId == "" {
+		return payments, nil
+	}
+
+	paymentIntents, err := Payments.ListPaymentIntents(user.StripeId, billingHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, pi := range paymentIntents {
+		if pi.Invoice != nil {
+			continue
+		}
+		payment := PaymentSummary{
+			Id:          pi.ID,
+			Description: pi.Description,
+			Status:      string(pi.Status),
+			Amount:      pi.Amount,
+			Currency:    string(pi.Currency),
+			Created:     time.Unix(pi.Created, 0).UTC(),
+		}
+		if pi.LatestCharge != nil {
+			payment.ReceiptURL = pi.LatestCharge.ReceiptURL
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
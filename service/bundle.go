@@ -0,0 +1,166 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// Stripe metadata values are limited to 500 characters, which caps how many
+// course IDs a cart can carry.
+const maxCartCourses = 12
+
+// GenerateBundleCheckoutLink sells every course in the bundle under the
+// bundle price. When the user already has some of the courses, the bundle
+// price no longer applies and the remaining courses are checked out as a cart.
+func GenerateBundleCheckoutLink(bundleID uuid.UUID, userID string, options CheckoutOptions) (*CheckoutLink, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	bundlePtr := database.GetBundle(bundleID)
+	if bundlePtr == nil {
+		return nil, errors.New("bundle not found")
+	}
+
+	courseIDs := make([]uuid.UUID, len(bundlePtr.CourseIds))
+	for i, courseId := range bundlePtr.CourseIds {
+		courseIDs[i] = courseId.Bytes
+	}
+
+	missingCourseIDs, err := filterAccessibleCourses(user, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(missingCourseIDs) == 0 {
+		return nil, errors.New("user already owns every course in this bundle")
+	}
+	if len(missingCourseIDs) < len(courseIDs) {
+		return generateCartCheckoutLink(user, missingCourseIDs, options)
+	}
+
+	locale := ResolveBuyerLocale(user, options)
+	lineItems := []*stripe.CheckoutSessionLineItemParams{
+		{
+			Price:    stripe.String(SelectBundlePriceId(bundlePtr, locale)),
+			Quantity: stripe.Int64(1),
+		},
+	}
+
+	userIdStr, _ := uuid.FromBytes(user.Id.Bytes[:])
+	metadata := map[string]string{
+		"userId":   userIdStr.String(),
+		"bundleId": bundleID.String(),
+		"type":     "bundle",
+	}
+
+	successURL := frontendURL + "/bundle/" + bundleID.String() + "/payment-successful"
+	return createCoursePaymentSession(user, courseIDs, lineItems, metadata, successURL, options)
+}
+
+func GenerateCartCheckoutLink(courseIDs []uuid.UUID, userID string, options CheckoutOptions) (*CheckoutLink, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	courseIDs = uniqueCourseIds(courseIDs)
+	missingCourseIDs, err := filterAccessibleCourses(user, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(missingCourseIDs) != len(courseIDs) {
+		return nil, errors.New("user already owns a course in the cart")
+	}
+
+	return generateCartCheckoutLink(user, courseIDs, options)
+}
+
+func generateCartCheckoutLink(user *models.AppUser, courseIDs []uuid.UUID, options CheckoutOptions) (*CheckoutLink, error) {
+	if len(courseIDs) == 0 {
+		return nil, errors.New("cart is empty")
+	}
+	if len(courseIDs) > maxCartCourses {
+		return nil, errors.New("too many courses in the cart")
+	}
+
+	courses := make([]*models.Course, len(courseIDs))
+	for i, courseID := range courseIDs {
+		courses[i] = database.GetCourse(courseID)
+		if courses[i] == nil {
+			return nil, errors.New("course not found")
+		}
+	}
+
+	priceIds := SelectCoursesPriceIds(courses, ResolveBuyerLocale(user, options))
+	lineItems := make([]*stripe.CheckoutSessionLineItemParams, len(priceIds))
+	for i, priceId := range priceIds {
+		lineItems[i] = &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(priceId),
+			Quantity: stripe.Int64(1),
+		}
+	}
+
+	userIdStr, _ := uuid.FromBytes(user.Id.Bytes[:])
+	metadata := map[string]string{
+		"userId":    userIdStr.String(),
+		"courseIds": JoinCourseIds(courseIDs),
+		"type":      "cart",
+	}
+
+	return createCoursePaymentSession(user, courseIDs, lineItems, metadata, frontendURL+"/cart/payment-successful", options)
+}
+
+// filterAccessibleCourses returns the courses the user does not own yet.
+func filterAccessibleCourses(user *models.AppUser, courseIDs []uuid.UUID) ([]uuid.UUID, error) {
+	missing := []uuid.UUID{}
+	for _, courseID := range courseIDs {
+		decision, err := entitlement.ForCourse(user, courseID)
+		if err != nil {
+			return nil, err
+		}
+		if !decision.Owned() {
+			missing = append(missing, courseID)
+		}
+	}
+	return missing, nil
+}
+
+func uniqueCourseIds(courseIDs []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	result := []uuid.UUID{}
+	for _, courseID := range courseIDs {
+		if !seen[courseID] {
+			seen[courseID] = true
+			result = append(result, courseID)
+		}
+	}
+	return result
+}
+
+func JoinCourseIds(courseIDs []uuid.UUID) string {
+	ids := make([]string, len(courseIDs))
+	for i, courseID := range courseIDs {
+		ids[i] = courseID.String()
+	}
+	return strings.Join(ids, ",")
+}
+
+func SplitCourseIds(joined string) ([]uuid.UUID, error) {
+	courseIDs := []uuid.UUID{}
+	for _, id := range strings.Split(joined, ",") {
+		courseID, err := uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		courseIDs = append(courseIDs, courseID)
+	}
+	return courseIDs, nil
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+var (
+	ErrCertificateNotFound = errors.New("certificate not found")
+	ErrCourseNotCompleted  = errors.New("course not completed")
+	// A certificate cannot be changed once issued, so it waits until both
+	// the recipient's name and the course title are known
+	ErrCertificatePending = errors.New("certificate is waiting for a name or course title")
+)
+
+// certificateMinFontSize is as far as a long name or title is shrunk
+const certificateMinFontSize = 12
+
+var (
+	//go:embed fonts/DejaVuSansCondensed.ttf
+	certificateFont []byte
+	//go:embed fonts/DejaVuSansCondensed-Bold.ttf
+	certificateBoldFont []byte
+)
+
+// CertificateVerificationURL is the public page a certificate's QR code
+// points to.
+func CertificateVerificationURL(certificateId uuid.UUID) string {
+	return frontendURL + "/certificates/" + certificateId.String()
+}
+
+func courseCompleted(completed map[uuid.UUID]bool, course *models.Course) bool {
+	contents := 0
+	for _, chapter := range course.Chapters {
+		for _, content := range chapter.Contents {
+			if !completed[content.Id.Bytes] {
+				return false
+			}
+			contents++
+		}
+	}
+	return contents > 0
+}
+
+// IssueCertificate returns the user's certificate for the course, issuing
+// it first if the course is complete. A course is only ever certified once.
+func IssueCertificate(user *models.AppUser, courseId uuid.UUID) (*models.Certificate, error) {
+	completed, err := GetCompletedContentIds(user.Id.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return issueCertificate(user, courseId, completed)
+}
+
+func issueCertificate(user *models.AppUser, courseId uuid.UUID, completed map[uuid.UUID]bool) (*models.Certificate, error) {
+	coursePtr := database.GetCourse(courseId)
+	if coursePtr == nil {
+		return nil, ErrCourseNotFound
+	}
+
+	var certificate models.Certificate
+	err := database.DB.Where("user_id = ? AND course_id = ?", user.Id, courseId).First(&certificate).Error
+	if err == nil {
+		return &certificate, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if !courseCompleted(completed, coursePtr) {
+		return nil, ErrCourseNotCompleted
+	}
+	if strings.TrimSpace(user.DisplayName) == "" || strings.TrimSpace(coursePtr.Title) == "" {
+		return nil, ErrCertificatePending
+	}
+
+	certificate = models.Certificate{
+		UserID:        user.Id,
+		CourseID:      lib.NewUUID(courseId),
+		RecipientName: user.DisplayName,
+		CourseTitle:   coursePtr.Title,
+		IssuedAt:      time.Now(),
+	}
+	err = database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&certificate).Error
+	if err != nil {
+		return nil, err
+	}
+	// Another request may have issued it first
+	err = database.DB.Where("user_id = ? AND course_id = ?", user.Id, courseId).First(&certificate).Error
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// issueCertificateIfCompleted is run whenever content is newly completed.
+func issueCertificateIfCompleted(userId uuid.UUID, contentId uuid.UUID) {
+	courseId := contentCourseId(contentId)
+	if courseId == nil {
+		return
+	}
+
+	var user models.AppUser
+	if err := database.DB.Where("id = ?", userId).First(&user).Error; err != nil {
+		log.Printf("certificate check for %s failed: %v", userId, err)
+		return
+	}
+	_, err := IssueCertificate(&user, *courseId)
+	if err != nil && !errors.Is(err, ErrCourseNotCompleted) && !errors.Is(err, ErrCertificatePending) {
+		log.Printf("certificate check for %s failed: %v", userId, err)
+	}
+}
+
+// issuePendingCertificates issues the certificates for every course the
+// user has completed, once their name is known.
+func issuePendingCertificates(user *models.AppUser) error {
+	completed, err := GetCompletedContentIds(user.Id.Bytes)
+	if err != nil {
+		return err
+	}
+	for _, course := range database.Materials {
+		_, err := issueCertificate(user, course.Id.Bytes, completed)
+		if err != nil && !errors.Is(err, ErrCourseNotCompleted) && !errors.Is(err, ErrCertificatePending) {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetCertificate(certificateId uuid.UUID) (*models.Certificate, error) {
+	var certificate models.Certificate
+	err := database.DB.Where("id = ?", certificateId).First(&certificate).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCertificateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+func GetUserCertificates(user *models.AppUser) ([]models.Certificate, error) {
+	certificates := []models.Certificate{}
+	err := database.DB.Where("user_id = ?", user.Id).Order("issued_at").Find(&certificates).Error
+	return certificates, err
+}
+
+// RenderCertificatePDF draws the certificate on a landscape A4 page, in an
+// embedded Unicode font so names and titles keep characters like ğ and ş.
+func RenderCertificatePDF(certificate *models.Certificate) ([]byte, error) {
+	certificateId := uuid.UUID(certificate.Id.Bytes)
+	verificationURL := CertificateVerificationURL(certificateId)
+
+	qr, err := qrcode.Encode(verificationURL, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pdf.SetTitle("Certificate of Completion", true)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddUTF8FontFromBytes("DejaVu", "", certificateFont)
+	pdf.AddUTF8FontFromBytes("DejaVu", "B", certificateBoldFont)
+	pdf.AddPage()
+	pageWidth, pageHeight := pdf.GetPageSize()
+
+	pdf.SetLineWidth(1.5)
+	pdf.Rect(10, 10, pageWidth-20, pageHeight-20, "D")
+	pdf.SetLineWidth(0.3)
+	pdf.Rect(14, 14, pageWidth-28, pageHeight-28, "D")
+
+	// Long names and titles are shrunk to fit inside the border, and cut
+	// short if they do not fit even at the smallest size
+	line := func(y float64, style string, size float64, text string) {
+		width := pageWidth - 40
+		height := size / 2
+		pdf.SetFont("DejaVu", style, size)
+		for size > certificateMinFontSize && pdf.GetStringWidth(text) > width {
+			size--
+			pdf.SetFont("DejaVu", style, size)
+		}
+		if pdf.GetStringWidth(text) > width {
+			runes := []rune(text)
+			for len(runes) > 0 && pdf.GetStringWidth(string(runes)+"…") > width {
+				runes = runes[:len(runes)-1]
+			}
+			text = string(runes) + "…"
+		}
+		pdf.SetXY(20, y)
+		pdf.CellFormat(width, height, text, "", 0, "C", false, 0, "")
+	}
+	line(38, "B", 34, "Certificate of Completion")
+	line(68, "", 14, "This certifies that")
+	line(80, "B", 28, certificate.RecipientName)
+	line(102, "", 14, "has successfully completed the course")
+	line(114, "B", 22, certificate.CourseTitle)
+	line(134, "", 12, "Issued on "+certificate.IssuedAt.UTC().Format("January 2, 2006"))
+
+	pdf.SetFont("DejaVu", "", 9)
+	pdf.SetXY(22, pageHeight-32)
+	pdf.CellFormat(150, 5, "Certificate ID: "+certificateId.String(), "", 2, "L", false, 0, "")
+	pdf.SetX(22)
+	pdf.CellFormat(150, 5, "Verify at "+verificationURL, "", 0, "L", false, 0, "")
+
+	options := fpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("qr", options, bytes.NewReader(qr))
+	pdf.ImageOptions("qr", pageWidth-62, pageHeight-62, 40, 40, false, options, 0, "")
+
+	var buffer bytes.Buffer
+	if err := pdf.Output(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -1,17 +1,156 @@
 package service
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
 	"mehmetfd.dev/chessu-backend/database"
 	"mehmetfd.dev/chessu-backend/models"
 )
 
-func CreateUser(clerkUserId string) error {
+const (
+	clerkAPIURL           = "https://api.clerk.com/v1"
+	clerkBackfillPageSize = 100
+)
+
+var clerkClient = &http.Client{Timeout: 30 * time.Second}
+
+// CreateUser registers a Clerk user, crediting the referral code they
+// signed up with, if any.
+func CreateUser(clerkUserId string, displayName string, referralCode string) error {
 	var user models.AppUser
 	user.ClerkId = clerkUserId
+	user.DisplayName = displayName
+	user.ReferralCodeID = signupReferralCodeId(referralCode)
 
-	if err := database.DB.Save(&user).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		return enqueueStripeCustomerJob(tx, user.Id)
+	})
+	if err != nil {
 		return err
 	}
-	go GetOrCreateStripeCustomerIDForUser(user.Id.Bytes)
+
+	select {
+	case wakeStripeCustomerWorker <- struct{}{}:
+	default:
+	}
 	return nil
 }
+
+// ClerkDisplayName is the full name on a Clerk user object, or the username
+// when they have not given one.
+func ClerkDisplayName(data map[string]interface{}) string {
+	firstName, _ := data["first_name"].(string)
+	lastName, _ := data["last_name"].(string)
+	if name := strings.TrimSpace(firstName + " " + lastName); name != "" {
+		return name
+	}
+	username, _ := data["username"].(string)
+	return username
+}
+
+// UpdateUserDisplayName keeps the name printed on new certificates in sync
+// with Clerk, and issues the certificates that were waiting for a name.
+func UpdateUserDisplayName(clerkUserId string, displayName string) error {
+	err := database.DB.Model(&models.AppUser{}).Where("clerk_id = ?", clerkUserId).Update("display_name", displayName).Error
+	if err != nil || displayName == "" {
+		return err
+	}
+
+	var user models.AppUser
+	if err := database.DB.Where("clerk_id = ?", clerkUserId).First(&user).Error; err != nil {
+		return err
+	}
+	return issuePendingCertificates(&user)
+}
+
+// BackfillDisplayNames fetches the names of users created before names were
+// stored, in the background. It needs CLERK_SECRET_KEY and does nothing
+// without it.
+func BackfillDisplayNames() {
+	secretKey := os.Getenv("CLERK_SECRET_KEY")
+	if secretKey == "" {
+		log.Printf("CLERK_SECRET_KEY is not set, skipping display name backfill")
+		return
+	}
+
+	go func() {
+		// Paged by ID, so users without a name in Clerk are only asked for once
+		lastId := "00000000-0000-0000-0000-000000000000"
+		for {
+			var users []models.AppUser
+			err := database.DB.Select("id", "clerk_id").
+				Where("display_name = '' AND id > ?", lastId).
+				Order("id").Limit(clerkBackfillPageSize).
+				Find(&users).Error
+			if err != nil {
+				log.Printf("display name backfill failed: %v", err)
+				return
+			}
+			if len(users) == 0 {
+				return
+			}
+			lastId = uuidString(users[len(users)-1].Id.Bytes)
+
+			clerkUserIds := make([]string, len(users))
+			for i, user := range users {
+				clerkUserIds[i] = user.ClerkId
+			}
+			clerkUsers, err := fetchClerkUsers(secretKey, clerkUserIds)
+			if err != nil {
+				log.Printf("display name backfill failed: %v", err)
+				return
+			}
+			for _, clerkUser := range clerkUsers {
+				clerkUserId, _ := clerkUser["id"].(string)
+				name := ClerkDisplayName(clerkUser)
+				if clerkUserId == "" || name == "" {
+					continue
+				}
+				if err := UpdateUserDisplayName(clerkUserId, name); err != nil {
+					log.Printf("display name backfill for %s failed: %v", clerkUserId, err)
+				}
+			}
+		}
+	}()
+}
+
+func fetchClerkUsers(secretKey string, clerkUserIds []string) ([]map[string]interface{}, error) {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(len(clerkUserIds)))
+	for _, clerkUserId := range clerkUserIds {
+		query.Add("user_id", clerkUserId)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, clerkAPIURL+"/users?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+secretKey)
+
+	response, err := clerkClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clerk returned %s", response.Status)
+	}
+
+	var clerkUsers []map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&clerkUsers); err != nil {
+		return nil, err
+	}
+	return clerkUsers, nil
+}
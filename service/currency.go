@@ -0,0 +1,145 @@
+package service
+
+import (
+	"strings"
+
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// CheckoutOptions carries what the buyer sent along with a checkout or price
+// request.
+type CheckoutOptions struct {
+	PromotionCode  string
+	ReferralCode   string
+	Currency       string
+	Country        string
+	AcceptLanguage string
+}
+
+// BuyerLocale is the currency and country a buyer is priced in. Either may
+// be empty when it could not be determined.
+type BuyerLocale struct {
+	Currency string
+	Country  string
+}
+
+var countryCurrencies = map[string]string{
+	"US": "usd", "GB": "gbp", "CA": "cad", "AU": "aud", "NZ": "nzd",
+	"TR": "try", "IN": "inr", "JP": "jpy", "CH": "chf", "SE": "sek",
+	"NO": "nok", "DK": "dkk", "PL": "pln", "BR": "brl", "MX": "mxn",
+	"DE": "eur", "FR": "eur", "ES": "eur", "IT": "eur", "NL": "eur",
+	"BE": "eur", "AT": "eur", "IE": "eur", "PT": "eur", "FI": "eur",
+	"GR": "eur", "SK": "eur", "SI": "eur", "EE": "eur", "LV": "eur",
+	"LT": "eur", "LU": "eur", "MT": "eur", "CY": "eur", "HR": "eur",
+}
+
+// ResolveBuyerLocale picks the buyer's currency from, in order, an explicit
+// request parameter, the billing address on their Stripe customer and the
+// country the proxy or browser reports.
+func ResolveBuyerLocale(user *models.AppUser, options CheckoutOptions) BuyerLocale {
+	country := strings.ToUpper(options.Country)
+	if customerCountry := getCustomerCountry(user.StripeId); customerCountry != "" {
+		country = customerCountry
+	}
+	if country == "" {
+		country = countryFromAcceptLanguage(options.AcceptLanguage)
+	}
+
+	currency := strings.ToLower(options.Currency)
+	if currency == "" {
+		currency = countryCurrencies[country]
+	}
+
+	return BuyerLocale{Currency: currency, Country: country}
+}
+
+// selectPriceId returns the most specific price for the locale: the
+// "currency-COUNTRY" key, then the currency key, then the default price.
+// The boolean reports whether a localized price was found.
+func selectPriceId(priceIds map[string]string, defaultPriceId string, locale BuyerLocale) (string, bool) {
+	if locale.Currency != "" {
+		if priceId, ok := priceIds[locale.Currency+"-"+locale.Country]; ok && locale.Country != "" {
+			return priceId, true
+		}
+		if priceId, ok := priceIds[locale.Currency]; ok {
+			return priceId, true
+		}
+	}
+	return defaultPriceId, false
+}
+
+func SelectCoursePriceId(course *models.Course, locale BuyerLocale) string {
+	priceId, _ := selectPriceId(course.StripePriceIds, course.StripePriceId, locale)
+	return priceId
+}
+
+// SelectCoursesPriceIds prices several courses for one checkout session.
+// Stripe requires every line item to share a currency, so when any course
+// has no price for the locale all of them fall back to their default price.
+func SelectCoursesPriceIds(courses []*models.Course, locale BuyerLocale) []string {
+	priceIds := make([]string, len(courses))
+	for i, course := range courses {
+		priceId, localized := selectPriceId(course.StripePriceIds, course.StripePriceId, locale)
+		if !localized {
+			for j, course := range courses {
+				priceIds[j] = course.StripePriceId
+			}
+			return priceIds
+		}
+		priceIds[i] = priceId
+	}
+	return priceIds
+}
+
+func SelectBundlePriceId(bundle *models.Bundle, locale BuyerLocale) string {
+	priceId, _ := selectPriceId(bundle.StripePriceIds, bundle.StripePriceId, locale)
+	return priceId
+}
+
+func SelectMembershipPlanPriceId(plan *models.MembershipPlan, locale BuyerLocale) string {
+	priceId, _ := selectPriceId(plan.StripePriceIds, plan.StripePriceId, locale)
+	return priceId
+}
+
+func getCustomerCountry(stripeCustomerId string) string {
+	if stripeCustomerId == "" {
+		return ""
+	}
+
+	var country string
+	if readStripeCache(customerCountryCacheKey(stripeCustomerId), &country) {
+		return country
+	}
+
+	c, err := Payments.GetCustomer(stripeCustomerId)
+	if err != nil {
+		return ""
+	}
+	if c.Address != nil {
+		country = strings.ToUpper(c.Address.Country)
+	}
+	writeStripeCache(customerCountryCacheKey(stripeCustomerId), &country)
+	return country
+}
+
+func InvalidateCachedCustomerCountry(stripeCustomerId string) error {
+	return invalidateStripeCache(customerCountryCacheKey(stripeCustomerId))
+}
+
+func customerCountryCacheKey(stripeCustomerId string) string {
+	return "stripe:customer-country:" + stripeCustomerId
+}
+
+// countryFromAcceptLanguage reads the region of the first language tag,
+// e.g. "de-DE,de;q=0.9" gives "DE".
+func countryFromAcceptLanguage(acceptLanguage string) string {
+	first := strings.TrimSpace(strings.Split(acceptLanguage, ",")[0])
+	first = strings.Split(first, ";")[0]
+	parts := strings.FieldsFunc(first, func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	if len(parts) < 2 || len(parts[len(parts)-1]) != 2 {
+		return ""
+	}
+	return strings.ToUpper(parts[len(parts)-1])
+}
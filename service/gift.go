@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const giftCodeValidity = 365 * 24 * time.Hour
+
+var (
+	ErrGiftCodeNotFound = errors.New("gift code not found")
+	ErrGiftCodeRedeemed = errors.New("gift code has already been redeemed")
+	ErrGiftCodeExpired  = errors.New("gift code has expired")
+	ErrGiftCodeRevoked  = errors.New("gift code has been revoked")
+	ErrAlreadyOwned     = errors.New("user already owns this course")
+)
+
+func GenerateGiftCheckoutLink(courseID uuid.UUID, userID string, options CheckoutOptions) (*CheckoutLink, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	coursePtr := database.GetCourse(courseID)
+	if coursePtr == nil {
+		return nil, errors.New("course not found")
+	}
+
+	locale := ResolveBuyerLocale(user, options)
+	lineItems := []*stripe.CheckoutSessionLineItemParams{
+		{
+			Price:    stripe.String(SelectCoursePriceId(coursePtr, locale)),
+			Quantity: stripe.Int64(1),
+		},
+	}
+
+	userIdStr, _ := uuid.FromBytes(user.Id.Bytes[:])
+	metadata := map[string]string{
+		"userId":   userIdStr.String(),
+		"courseId": courseID.String(),
+		"type":     "gift",
+	}
+
+	return createCoursePaymentSession(user, []uuid.UUID{courseID}, lineItems, metadata, frontendURL+"/gift/payment-successful", options)
+}
+
+// CreateGiftCode issues the redemption code for a paid gift checkout. It is
+// idempotent per checkout session.
+func CreateGiftCode(buyerId uuid.UUID, courseId uuid.UUID, sessionObj *stripe.CheckoutSession) (*models.GiftCode, error) {
+	var existing models.GiftCode
+	err := database.DB.Where("stripe_checkout_session_id = ?", sessionObj.ID).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	code, err := lib.RandomCode(3, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	gift := models.GiftCode{
+		Code:                    code,
+		BuyerID:                 lib.NewUUID(buyerId),
+		CourseID:                lib.NewUUID(courseId),
+		AmountTotal:             sessionObj.AmountTotal,
+		Currency:                string(sessionObj.Currency),
+		StripeCheckoutSessionID: sessionObj.ID,
+		ExpiresAt:               time.Now().Add(giftCodeValidity),
+	}
+	if sessionObj.PaymentIntent != nil {
+		gift.StripePaymentIntentID = sessionObj.PaymentIntent.ID
+	}
+
+	if err := database.DB.Create(&gift).Error; err != nil {
+		return nil, err
+	}
+	return &gift, nil
+}
+
+func RedeemGiftCode(code string, userID string) (*models.GiftCode, error) {
+	code = lib.NormalizeCode(code)
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var gift models.GiftCode
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&gift).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrGiftCodeNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case gift.RevokedAt != nil:
+			return ErrGiftCodeRevoked
+		case gift.RedeemedAt != nil:
+			return ErrGiftCodeRedeemed
+		case gift.ExpiresAt.Before(time.Now()):
+			return ErrGiftCodeExpired
+		}
+
+		decision, err := entitlement.ForCourse(user, gift.CourseID.Bytes)
+		if err != nil {
+			return err
+		}
+		if decision.Owned() {
+			return ErrAlreadyOwned
+		}
+
+		grant := models.AccessGrant{
+			UserID:   user.Id,
+			CourseID: gift.CourseID,
+			Source:   models.AccessGrantSourceGift,
+			Note:     gift.Code,
+		}
+		if err := tx.Create(&grant).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		gift.RedeemedAt = &now
+		gift.RedeemedByID = &user.Id
+		gift.AccessGrantID = &grant.Id
+		return tx.Save(&gift).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &gift, nil
+}
+
+// RevokeGiftCode stops a gift code from being used. Buyers may only revoke
+// codes that have not been claimed; revokeClaimed also takes the course away
+// from the recipient and is meant for refunds.
+func RevokeGiftCode(code string, buyerId *uuid.UUID, revokeClaimed bool) error {
+	code = lib.NormalizeCode(code)
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var gift models.GiftCode
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code)
+		if buyerId != nil {
+			query = query.Where("buyer_id = ?", *buyerId)
+		}
+		err := query.First(&gift).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrGiftCodeNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if gift.RevokedAt != nil {
+			return nil
+		}
+		if gift.RedeemedAt != nil && !revokeClaimed {
+			return ErrGiftCodeRedeemed
+		}
+
+		now := time.Now()
+		if gift.AccessGrantID != nil {
+			err := tx.Model(&models.AccessGrant{}).
+				Where("id = ?", *gift.AccessGrantID).
+				Update("revoked_at", now).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		gift.RevokedAt = &now
+		return tx.Save(&gift).Error
+	})
+}
+
+func GetPurchasedGiftCodes(buyerId uuid.UUID) ([]models.GiftCode, error) {
+	var gifts []models.GiftCode
+	err := database.DB.Where("buyer_id = ?", buyerId).Order("created_at desc").Find(&gifts).Error
+	return gifts, err
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	// The frontend sends a heartbeat about every 15 seconds while content is
+	// open. A longer gap means the tab was closed or asleep and is not counted.
+	maxHeartbeatGap        = 60 * time.Second
+	heartbeatFlushInterval = time.Minute
+
+	heartbeatPendingKey   = "progress:heartbeat:pending"
+	heartbeatFlushingKey  = "progress:heartbeat:flushing"
+	heartbeatFlushLockKey = "progress:heartbeat:flush-lock"
+	// Longer than any flush should take, so a crashed instance cannot hold
+	// the lock for long
+	heartbeatFlushLockTTL   = 5 * time.Minute
+	heartbeatFlushBatchSize = 1000
+)
+
+var ErrMinimumTimeNotReached = errors.New("minimum time on content not reached")
+
+// recordHeartbeatScript credits the time since the previous heartbeat for
+// the same user and content to the pending hash, all in one round trip.
+var recordHeartbeatScript = redis.NewScript(`
+local last = redis.call('GET', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[3])
+if not last then
+	return 0
+end
+local gap = tonumber(ARGV[1]) - tonumber(last)
+if gap <= 0 or gap > tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('HINCRBY', KEYS[2], ARGV[2], gap)
+return gap
+`)
+
+// releaseLockScript deletes a lock only if it still holds this instance's
+// token, so a lock that expired and was taken by another instance is kept.
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func heartbeatField(userId uuid.UUID, contentId uuid.UUID) string {
+	return userId.String() + ":" + contentId.String()
+}
+
+func lastHeartbeatKey(userId uuid.UUID, contentId uuid.UUID) string {
+	return "progress:heartbeat:last:" + heartbeatField(userId, contentId)
+}
+
+// RecordHeartbeat notes that the user has the content open and returns the
+// seconds credited for it.
+func RecordHeartbeat(userId uuid.UUID, contentId uuid.UUID) (int64, error) {
+	return recordHeartbeatScript.Run(
+		context.Background(),
+		database.Redis,
+		[]string{lastHeartbeatKey(userId, contentId), heartbeatPendingKey},
+		time.Now().Unix(),
+		heartbeatField(userId, contentId),
+		int64(maxHeartbeatGap/time.Second),
+	).Int64()
+}
+
+// ContentTimeSpent is the user's time on the content, including heartbeats
+// that have not been flushed to Postgres yet.
+func ContentTimeSpent(userId uuid.UUID, contentId uuid.UUID) (int64, error) {
+	var progress models.ContentProgress
+	err := database.DB.Where("user_id = ? AND content_id = ?", userId, contentId).Limit(1).Find(&progress).Error
+	if err != nil {
+		return 0, err
+	}
+
+	total := progress.TimeSpentSeconds
+	field := heartbeatField(userId, contentId)
+	for _, key := range []string{heartbeatPendingKey, heartbeatFlushingKey} {
+		seconds, err := database.Redis.HGet(context.Background(), key, field).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return 0, err
+		}
+		total += seconds
+	}
+	return total, nil
+}
+
+// CheckMinimumTime refuses a completion while the user has spent less than
+// the content's MinimumSeconds on it.
+func CheckMinimumTime(userId uuid.UUID, content *models.Content) (int64, error) {
+	if content.MinimumSeconds <= 0 {
+		return 0, nil
+	}
+	timeSpent, err := ContentTimeSpent(userId, content.Id.Bytes)
+	if err != nil {
+		return 0, err
+	}
+	if timeSpent < int64(content.MinimumSeconds) {
+		return timeSpent, ErrMinimumTimeNotReached
+	}
+	return timeSpent, nil
+}
+
+// StartHeartbeatFlusher moves buffered heartbeat time from Redis into
+// content progress every minute.
+func StartHeartbeatFlusher() {
+	go func() {
+		ticker := time.NewTicker(heartbeatFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := flushHeartbeats(); err != nil {
+				log.Printf("heartbeat flush failed: %v", err)
+			}
+		}
+	}()
+}
+
+// flushHeartbeats renames the pending hash so new heartbeats keep
+// accumulating while it is written out. A flushing hash left behind by a
+// failed flush is retried before anything new is taken. Only one instance
+// flushes at a time; the others skip the tick.
+func flushHeartbeats() error {
+	ctx := context.Background()
+
+	token := uuid.NewString()
+	acquired, err := database.Redis.SetNX(ctx, heartbeatFlushLockKey, token, heartbeatFlushLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+	defer func() {
+		if err := releaseLockScript.Run(ctx, database.Redis, []string{heartbeatFlushLockKey}, token).Err(); err != nil {
+			log.Printf("releasing heartbeat flush lock failed: %v", err)
+		}
+	}()
+
+	exists, err := database.Redis.Exists(ctx, heartbeatFlushingKey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		err := database.Redis.Rename(ctx, heartbeatPendingKey, heartbeatFlushingKey).Err()
+		if err != nil && strings.Contains(err.Error(), "no such key") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fields, err := database.Redis.HGetAll(ctx, heartbeatFlushingKey).Result()
+	if err != nil {
+		return err
+	}
+
+	rows := make([]models.ContentProgress, 0, len(fields))
+	for field, value := range fields {
+		ids := strings.SplitN(field, ":", 2)
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if len(ids) != 2 || err != nil || seconds <= 0 {
+			continue
+		}
+		userId, userErr := uuid.Parse(ids[0])
+		contentId, contentErr := uuid.Parse(ids[1])
+		if userErr != nil || contentErr != nil {
+			continue
+		}
+		progress := newContentProgress(userId, contentId, models.ContentProgressStatusStarted)
+		progress.TimeSpentSeconds = seconds
+		rows = append(rows, progress)
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := addContentTime(tx, rows); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := recordDailyActivity(tx, row.UserID.Bytes, 0, 0, row.TimeSpentSeconds); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := database.Redis.Del(ctx, heartbeatFlushingKey).Err(); err != nil {
+		return err
+	}
+
+	// Time alone can meet a minutes goal, and so extend a streak
+	users := map[uuid.UUID]bool{}
+	for _, row := range rows {
+		if !users[row.UserID.Bytes] {
+			users[row.UserID.Bytes] = true
+			spendStreakFreezes(row.UserID.Bytes)
+			if err := rewardStreak(row.UserID.Bytes); err != nil {
+				log.Printf("rewarding streak for %s failed: %v", uuidString(row.UserID.Bytes), err)
+			}
+		}
+	}
+	return nil
+}
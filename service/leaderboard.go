@@ -0,0 +1,464 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	LeaderboardXP            = "xp"
+	LeaderboardPuzzlesSolved = "puzzles_solved"
+	LeaderboardPuzzleRating  = "puzzle_rating"
+
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+	PeriodAllTime = "all_time"
+
+	ScopeGlobal       = "global"
+	ScopeCourse       = "course"
+	ScopeOrganization = "organization"
+)
+
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+	leaderboardNeighbours   = 2
+
+	// Period boards are kept a while after they close
+	weeklyLeaderboardTTL  = 8 * 7 * 24 * time.Hour
+	monthlyLeaderboardTTL = 13 * 31 * 24 * time.Hour
+
+	defaultPuzzleRating = 1500
+	puzzleRatingK       = 32
+)
+
+var ErrInvalidLeaderboard = errors.New("invalid leaderboard")
+
+var leaderboardPeriods = []string{PeriodWeekly, PeriodMonthly, PeriodAllTime}
+
+type LeaderboardEntry struct {
+	Rank   int64   `json:"rank"`
+	UserId string  `json:"userId"`
+	Score  float64 `json:"score"`
+}
+
+// Leaderboard is the top of a board together with the caller's own entry
+// and the entries around it. Me is nil when the caller is not on the board.
+type Leaderboard struct {
+	Metric     string             `json:"metric"`
+	Period     string             `json:"period"`
+	Scope      string             `json:"scope"`
+	ScopeId    string             `json:"scopeId,omitempty"`
+	OptedOut   bool               `json:"optedOut"`
+	Entries    []LeaderboardEntry `json:"entries"`
+	Me         *LeaderboardEntry  `json:"me"`
+	Neighbours []LeaderboardEntry `json:"neighbours"`
+}
+
+func leaderboardKey(metric string, period string, at time.Time, scope string) string {
+	at = at.UTC()
+	switch period {
+	case PeriodWeekly:
+		year, week := at.ISOWeek()
+		period = fmt.Sprintf("weekly:%d-W%02d", year, week)
+	case PeriodMonthly:
+		period = at.Format("monthly:2006-01")
+	}
+	return "leaderboard:" + metric + ":" + period + ":" + scope
+}
+
+func leaderboardTTL(period string) time.Duration {
+	switch period {
+	case PeriodWeekly:
+		return weeklyLeaderboardTTL
+	case PeriodMonthly:
+		return monthlyLeaderboardTTL
+	}
+	return 0
+}
+
+func courseScope(courseId uuid.UUID) string {
+	return ScopeCourse + ":" + courseId.String()
+}
+
+func organizationScope(organizationId [16]byte) string {
+	return ScopeOrganization + ":" + uuidString(organizationId)
+}
+
+// leaderboardScopes lists the boards a user's scores go to, or nil when the
+// user has opted out. Puzzle ratings are not kept per course.
+func leaderboardScopes(userId uuid.UUID, metric string, courseId *uuid.UUID) ([]string, error) {
+	var user models.AppUser
+	if err := database.DB.Select("id", "leaderboard_opt_out").Where("id = ?", userId).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.LeaderboardOptOut {
+		return nil, nil
+	}
+
+	var organizationIds []lib.UUID
+	if err := database.DB.Model(&models.OrganizationMember{}).Where("user_id = ?", userId).Pluck("organization_id", &organizationIds).Error; err != nil {
+		return nil, err
+	}
+
+	scopes := []string{ScopeGlobal}
+	for _, organizationId := range organizationIds {
+		scopes = append(scopes, organizationScope(organizationId.Bytes))
+	}
+	if courseId != nil && metric != LeaderboardPuzzleRating {
+		scopes = append(scopes, courseScope(*courseId))
+	}
+	return scopes, nil
+}
+
+// addLeaderboardScore adds delta to the user's score on every board the
+// event counts for, or sets the score to delta when absolute is true.
+// Leaderboards can be rebuilt from Postgres, so failures are only logged.
+func addLeaderboardScore(userId uuid.UUID, metric string, courseId *uuid.UUID, at time.Time, delta float64, absolute bool) {
+	scopes, err := leaderboardScopes(userId, metric, courseId)
+	if err != nil {
+		log.Printf("leaderboard update for %s failed: %v", userId, err)
+		return
+	}
+
+	ctx := context.Background()
+	pipe := database.Redis.Pipeline()
+	for _, scope := range scopes {
+		for _, period := range leaderboardPeriods {
+			key := leaderboardKey(metric, period, at, scope)
+			if absolute {
+				pipe.ZAdd(ctx, key, redis.Z{Score: delta, Member: userId.String()})
+			} else {
+				pipe.ZIncrBy(ctx, key, delta, userId.String())
+			}
+			if ttl := leaderboardTTL(period); ttl > 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("leaderboard update for %s failed: %v", userId, err)
+	}
+}
+
+// contentCourseId is the course a piece of content belongs to, or nil.
+func contentCourseId(contentId uuid.UUID) *uuid.UUID {
+	coursePtr, _, _ := database.GetCourseAndChapterAndContent(contentId)
+	if coursePtr == nil {
+		return nil
+	}
+	courseId := uuid.UUID(coursePtr.Id.Bytes)
+	return &courseId
+}
+
+// recordXPOnLeaderboards puts newly paid XP on the boards. Content XP also
+// counts towards its course.
+func recordXPOnLeaderboards(userId uuid.UUID, events []models.XPEvent) {
+	for _, event := range events {
+		var courseId *uuid.UUID
+		if event.Source == models.XPSourceContent {
+			if contentId, err := uuid.Parse(event.SourceID); err == nil {
+				courseId = contentCourseId(contentId)
+			}
+		}
+		addLeaderboardScore(userId, LeaderboardXP, courseId, time.Now(), float64(event.Amount), false)
+	}
+}
+
+// puzzleRatingChange is the Elo change for a player rated rating after
+// solving, or failing, a puzzle rated puzzleRating.
+func puzzleRatingChange(rating int, puzzleRating int, solved bool) int {
+	if puzzleRating <= 0 {
+		puzzleRating = defaultPuzzleRating
+	}
+	expected := 1 / (1 + math.Pow(10, float64(puzzleRating-rating)/400))
+	result := 0.0
+	if solved {
+		result = 1
+	}
+	return int(math.Round(puzzleRatingK * (result - expected)))
+}
+
+// RebuildLeaderboards fills the boards from Postgres when Redis has lost
+// them, e.g. after a flush, without blocking startup.
+func RebuildLeaderboards() {
+	exists, err := database.Redis.Exists(context.Background(), leaderboardKey(LeaderboardXP, PeriodAllTime, time.Now(), ScopeGlobal)).Result()
+	if err != nil || exists > 0 {
+		return
+	}
+
+	go func() {
+		var users []models.AppUser
+		err := database.DB.Where("leaderboard_opt_out = ?", false).FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+			for i := range users {
+				if err := rebuildUserLeaderboards(&users[i]); err != nil {
+					log.Printf("leaderboard rebuild for %s failed: %v", uuidString(users[i].Id.Bytes), err)
+				}
+			}
+			return nil
+		}).Error
+		if err != nil {
+			log.Printf("leaderboard rebuild failed: %v", err)
+		}
+	}()
+}
+
+// rebuildUserLeaderboards sets the user's scores on the all-time boards and
+// the boards of the current week and month.
+func rebuildUserLeaderboards(user *models.AppUser) error {
+	userId := uuid.UUID(user.Id.Bytes)
+	baseScopes, err := leaderboardScopes(userId, LeaderboardPuzzleRating, nil)
+	if err != nil || baseScopes == nil {
+		return err
+	}
+
+	now := time.Now()
+	scores := map[string]float64{}
+	ttls := map[string]time.Duration{}
+	add := func(metric string, courseId *uuid.UUID, at time.Time, value float64, absolute bool) {
+		scopes := baseScopes
+		if courseId != nil && metric != LeaderboardPuzzleRating {
+			scopes = append(scopes[:len(scopes):len(scopes)], courseScope(*courseId))
+		}
+		for _, scope := range scopes {
+			for _, period := range leaderboardPeriods {
+				key := leaderboardKey(metric, period, now, scope)
+				if leaderboardKey(metric, period, at, scope) != key {
+					continue
+				}
+				if absolute {
+					scores[key] = value
+				} else {
+					scores[key] += value
+				}
+				ttls[key] = leaderboardTTL(period)
+			}
+		}
+	}
+
+	var events []models.XPEvent
+	if err := database.DB.Where("user_id = ?", user.Id).Find(&events).Error; err != nil {
+		return err
+	}
+	for _, event := range events {
+		var courseId *uuid.UUID
+		if event.Source == models.XPSourceContent {
+			if contentId, err := uuid.Parse(event.SourceID); err == nil {
+				courseId = contentCourseId(contentId)
+			}
+		}
+		add(LeaderboardXP, courseId, event.CreatedAt, float64(event.Amount), false)
+	}
+
+	var rows []models.ContentProgress
+	if err := database.DB.Where("user_id = ?", user.Id).Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		coursePtr, _, contentPtr := database.GetCourseAndChapterAndContent(row.ContentID.Bytes)
+		if contentPtr == nil || contentPtr.Type != models.ContentTypePuzzle {
+			continue
+		}
+		courseId := uuid.UUID(coursePtr.Id.Bytes)
+		if row.Attempts > 0 {
+			add(LeaderboardPuzzleRating, nil, row.UpdatedAt, float64(user.PuzzleRating), true)
+		}
+		if row.Status == models.ContentProgressStatusCompleted && row.CompletedAt != nil {
+			add(LeaderboardPuzzlesSolved, &courseId, *row.CompletedAt, 1, false)
+		}
+	}
+
+	ctx := context.Background()
+	pipe := database.Redis.Pipeline()
+	for key, score := range scores {
+		pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: userId.String()})
+		if ttls[key] > 0 {
+			pipe.Expire(ctx, key, ttls[key])
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// SetLeaderboardOptOut hides the user from every board, or puts them back
+// with the scores Postgres has for them.
+func SetLeaderboardOptOut(user *models.AppUser, optOut bool) error {
+	if err := database.DB.Model(&models.AppUser{}).Where("id = ?", user.Id).Update("leaderboard_opt_out", optOut).Error; err != nil {
+		return err
+	}
+	user.LeaderboardOptOut = optOut
+	if !optOut {
+		return rebuildUserLeaderboards(user)
+	}
+	return removeFromLeaderboards(uuidString(user.Id.Bytes))
+}
+
+func removeFromLeaderboards(member string) error {
+	ctx := context.Background()
+	iter := database.Redis.Scan(ctx, 0, "leaderboard:*", 500).Iterator()
+	for iter.Next(ctx) {
+		if err := database.Redis.ZRem(ctx, iter.Val(), member).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func validLeaderboard(metric string, period string, scope string) bool {
+	switch metric {
+	case LeaderboardXP, LeaderboardPuzzlesSolved, LeaderboardPuzzleRating:
+	default:
+		return false
+	}
+	switch period {
+	case PeriodWeekly, PeriodMonthly, PeriodAllTime:
+	default:
+		return false
+	}
+	switch scope {
+	case ScopeGlobal, ScopeOrganization:
+		return true
+	case ScopeCourse:
+		return metric != LeaderboardPuzzleRating
+	}
+	return false
+}
+
+// GetLeaderboard returns the top limit entries of a board along with the
+// caller's rank and neighbours. Organization boards are only shown to the
+// organization's members.
+func GetLeaderboard(user *models.AppUser, metric string, period string, scope string, scopeId string, limit int) (*Leaderboard, error) {
+	if !validLeaderboard(metric, period, scope) {
+		return nil, ErrInvalidLeaderboard
+	}
+	if limit <= 0 {
+		limit = defaultLeaderboardLimit
+	}
+	if limit > maxLeaderboardLimit {
+		limit = maxLeaderboardLimit
+	}
+
+	scopeKey := ScopeGlobal
+	if scope != ScopeGlobal {
+		id, err := uuid.Parse(scopeId)
+		if err != nil {
+			return nil, ErrInvalidLeaderboard
+		}
+		if scope == ScopeCourse {
+			if database.GetCourse(id) == nil {
+				return nil, ErrCourseNotFound
+			}
+			scopeKey = courseScope(id)
+		} else {
+			var count int64
+			err := database.DB.Model(&models.OrganizationMember{}).Where("organization_id = ? AND user_id = ?", id, user.Id).Count(&count).Error
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return nil, ErrNotOrganizationMember
+			}
+			scopeKey = organizationScope(id)
+		}
+	}
+
+	ctx := context.Background()
+	key := leaderboardKey(metric, period, time.Now(), scopeKey)
+	board := &Leaderboard{
+		Metric:     metric,
+		Period:     period,
+		Scope:      scope,
+		ScopeId:    scopeId,
+		OptedOut:   user.LeaderboardOptOut,
+		Neighbours: []LeaderboardEntry{},
+	}
+
+	top, err := database.Redis.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	members := []redis.Z{}
+	members = append(members, top...)
+
+	var neighbours []redis.Z
+	var neighboursFrom int64
+	member := uuidString(user.Id.Bytes)
+	rank, err := database.Redis.ZRevRank(ctx, key, member).Result()
+	if err == nil {
+		neighboursFrom = rank - leaderboardNeighbours
+		if neighboursFrom < 0 {
+			neighboursFrom = 0
+		}
+		neighbours, err = database.Redis.ZRevRangeWithScores(ctx, key, neighboursFrom, rank+leaderboardNeighbours).Result()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, neighbours...)
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	clerkIds, err := leaderboardClerkIds(members)
+	if err != nil {
+		return nil, err
+	}
+
+	board.Entries = leaderboardEntries(top, 0, clerkIds)
+	board.Neighbours = leaderboardEntries(neighbours, neighboursFrom, clerkIds)
+	for i := range board.Neighbours {
+		if board.Neighbours[i].Rank == rank+1 && neighbours[i].Member == member {
+			me := board.Neighbours[i]
+			board.Me = &me
+		}
+	}
+	return board, nil
+}
+
+// leaderboardClerkIds maps board members, which are internal user IDs, to
+// the Clerk IDs the frontend knows users by.
+func leaderboardClerkIds(members []redis.Z) (map[string]string, error) {
+	ids := []string{}
+	for _, z := range members {
+		if id, ok := z.Member.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	clerkIds := map[string]string{}
+	if len(ids) == 0 {
+		return clerkIds, nil
+	}
+
+	var users []models.AppUser
+	if err := database.DB.Select("id", "clerk_id").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		clerkIds[uuidString(user.Id.Bytes)] = user.ClerkId
+	}
+	return clerkIds, nil
+}
+
+func leaderboardEntries(members []redis.Z, from int64, clerkIds map[string]string) []LeaderboardEntry {
+	entries := make([]LeaderboardEntry, len(members))
+	for i, z := range members {
+		member, _ := z.Member.(string)
+		entries[i] = LeaderboardEntry{
+			Rank:   from + int64(i) + 1,
+			UserId: clerkIds[member],
+			Score:  z.Score,
+		}
+	}
+	return entries
+}
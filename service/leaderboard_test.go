@@ -0,0 +1,28 @@
+package service
+
+import "testing"
+
+func TestPuzzleRatingChange(t *testing.T) {
+	tests := []struct {
+		name         string
+		rating       int
+		puzzleRating int
+		solved       bool
+		want         int
+	}{
+		{"even, solved", 1500, 1500, true, 16},
+		{"even, failed", 1500, 1500, false, -16},
+		{"unrated puzzle", 1500, 0, true, 16},
+		{"harder puzzle solved", 1500, 1900, true, 29},
+		{"harder puzzle failed", 1500, 1900, false, -3},
+		{"easier puzzle solved", 1900, 1500, true, 3},
+		{"easier puzzle failed", 1900, 1500, false, -29},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := puzzleRatingChange(tt.rating, tt.puzzleRating, tt.solved); got != tt.want {
+				t.Errorf("puzzleRatingChange(%d, %d, %v) = %d, want %d", tt.rating, tt.puzzleRating, tt.solved, got, tt.want)
+			}
+		})
+	}
+}
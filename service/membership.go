@@ -0,0 +1,192 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+var (
+	ErrNoMembership            = errors.New("user does not have a membership")
+	ErrMembershipPlanNotFound  = errors.New("membership plan not found")
+	ErrAlreadyOnMembershipPlan = errors.New("user is already on this plan")
+	ErrMembershipPlanCurrency  = errors.New("membership plan is not sold in the subscription's currency")
+)
+
+func GetSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	return Payments.GetSubscription(subscriptionID)
+}
+
+// ChangeMembershipPlan moves an active subscription to another plan. An
+// upgrade to a higher ranked plan is invoiced right away for the rest of the
+// period, while a downgrade is credited on the next invoice.
+func ChangeMembershipPlan(userID uuid.UUID, planID string) (*models.Membership, error) {
+	var user models.AppUser
+	if err := database.DB.Preload(clause.Associations).Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	if !entitlement.HasActiveMembership(&user) {
+		return nil, ErrNoMembership
+	}
+
+	plan := database.GetMembershipPlan(planID)
+	if plan == nil {
+		return nil, ErrMembershipPlanNotFound
+	}
+	if user.Membership.PlanID == plan.Id {
+		return nil, ErrAlreadyOnMembershipPlan
+	}
+
+	existingSubscription, err := Payments.GetSubscription(user.Membership.StripeSubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if existingSubscription.Items == nil || len(existingSubscription.Items.Data) == 0 {
+		return nil, errors.New("subscription has no items")
+	}
+	item := existingSubscription.Items.Data[0]
+
+	// Stripe cannot mix currencies within a subscription
+	currency := string(item.Price.Currency)
+	priceID := SelectMembershipPlanPriceId(plan, BuyerLocale{Currency: currency})
+	newPrice, err := GetCachedPrice(priceID)
+	if err != nil {
+		return nil, err
+	}
+	if newPrice.Currency != currency {
+		return nil, ErrMembershipPlanCurrency
+	}
+
+	prorationBehavior := "create_prorations"
+	if currentPlan := database.GetMembershipPlan(user.Membership.PlanID); currentPlan != nil && plan.Rank > currentPlan.Rank {
+		prorationBehavior = "always_invoice"
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(item.ID),
+				Price: stripe.String(priceID),
+			},
+		},
+		ProrationBehavior: stripe.String(prorationBehavior),
+	}
+	params.AddMetadata("planId", plan.Id)
+
+	updatedSubscription, err := Payments.UpdateSubscription(existingSubscription.ID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	membership := user.Membership
+	membership.PlanID = plan.Id
+	periodEnd := time.Unix(updatedSubscription.CurrentPeriodEnd, 0).UTC()
+	if membership.ValidUntil.Before(periodEnd) {
+		membership.ValidUntil = periodEnd
+	}
+	if err := database.DB.Save(membership).Error; err != nil {
+		return nil, err
+	}
+
+	return membership, nil
+}
+
+// ActivateMembership records a subscription bought through checkout on the
+// user's membership, reusing a lapsed membership row if there is one.
+func ActivateMembership(user *models.AppUser, subscriptionObj *stripe.Subscription, planId string) error {
+	validUntil := time.Unix(subscriptionObj.CurrentPeriodEnd, 0).UTC()
+
+	membership := user.Membership
+	if membership == nil {
+		membership = &models.Membership{
+			UserID:     user.Id,
+			ValidUntil: validUntil,
+		}
+	}
+
+	membership.StripeSubscriptionID = subscriptionObj.ID
+	membership.PlanID = planId
+	applySubscriptionStatus(membership, subscriptionObj)
+
+	if membership.Status == models.MembershipStatusTrialing && user.TrialUsedAt == nil {
+		now := time.Now()
+		user.TrialUsedAt = &now
+	}
+
+	if subscriptionLive(subscriptionObj) && membership.ValidUntil.Before(validUntil) {
+		membership.ValidUntil = validUntil
+	}
+	if err := database.DB.Save(membership).Error; err != nil {
+		return err
+	}
+
+	user.Membership = membership
+	return database.DB.Save(user).Error
+}
+
+// SyncMembership brings a membership in line with its Stripe subscription.
+func SyncMembership(membership *models.Membership, subscriptionObj *stripe.Subscription) error {
+	applySubscriptionStatus(membership, subscriptionObj)
+	if planId := subscriptionObj.Metadata["planId"]; planId != "" {
+		membership.PlanID = planId
+	}
+
+	// A subscription that is not being paid for does not extend access
+	validUntil := time.Unix(subscriptionObj.CurrentPeriodEnd, 0).UTC()
+	if subscriptionObj.Status == stripe.SubscriptionStatusTrialing ||
+		(subscriptionLive(subscriptionObj) && membership.ValidUntil.Before(validUntil)) {
+		membership.ValidUntil = validUntil
+	}
+
+	return database.DB.Save(membership).Error
+}
+
+// EndMembership removes the membership of a deleted subscription, which is
+// also how a trial that was not converted into a paid subscription ends.
+func EndMembership(subscriptionID string) error {
+	return database.DB.Where("stripe_subscription_id = ?", subscriptionID).Delete(&models.Membership{}).Error
+}
+
+// subscriptionLive reports whether a subscription is currently paid for or
+// in its trial.
+func subscriptionLive(subscriptionObj *stripe.Subscription) bool {
+	return subscriptionObj.Status == stripe.SubscriptionStatusActive ||
+		subscriptionObj.Status == stripe.SubscriptionStatusTrialing
+}
+
+// membershipStatus maps a Stripe subscription status onto the membership's.
+func membershipStatus(status stripe.SubscriptionStatus) string {
+	switch status {
+	case stripe.SubscriptionStatusActive:
+		return models.MembershipStatusActive
+	case stripe.SubscriptionStatusTrialing:
+		return models.MembershipStatusTrialing
+	case stripe.SubscriptionStatusPastDue:
+		return models.MembershipStatusPastDue
+	case stripe.SubscriptionStatusUnpaid:
+		return models.MembershipStatusUnpaid
+	case stripe.SubscriptionStatusPaused:
+		return models.MembershipStatusPaused
+	case stripe.SubscriptionStatusIncomplete:
+		return models.MembershipStatusIncomplete
+	default:
+		// canceled, incomplete_expired and anything Stripe adds later
+		return models.MembershipStatusCanceled
+	}
+}
+
+func applySubscriptionStatus(membership *models.Membership, subscriptionObj *stripe.Subscription) {
+	membership.Status = membershipStatus(subscriptionObj.Status)
+	if subscriptionObj.Status == stripe.SubscriptionStatusTrialing {
+		trialEndsAt := time.Unix(subscriptionObj.TrialEnd, 0).UTC()
+		membership.TrialEndsAt = &trialEndsAt
+	}
+}
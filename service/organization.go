@@ -0,0 +1,636 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	maxSeatQuantity            = 1000
+	organizationInviteValidity = 30 * 24 * time.Hour
+)
+
+var (
+	ErrOrganizationNotFound  = errors.New("organization not found")
+	ErrNotOrganizationAdmin  = errors.New("user is not an admin of this organization")
+	ErrNotOrganizationMember = errors.New("user is not a member of this organization")
+	ErrSeatLicenseNotFound   = errors.New("seat license not found")
+	ErrInvalidSeatQuantity   = errors.New("seat quantity is out of range")
+	ErrNoSeatsAvailable      = errors.New("every seat of this license is assigned")
+	ErrSeatAlreadyAssigned   = errors.New("user already has a seat of this license")
+	ErrSeatNotAssigned       = errors.New("user does not have a seat of this license")
+	ErrInviteNotFound        = errors.New("invite not found")
+	ErrInviteExpired         = errors.New("invite has expired")
+	ErrInviteRevoked         = errors.New("invite has been revoked")
+	ErrInviteUsedUp          = errors.New("invite has no uses left")
+)
+
+type OrganizationMemberSummary struct {
+	UserId     string   `json:"userId"`
+	Role       string   `json:"role"`
+	LicenseIds []string `json:"licenseIds"`
+}
+
+type SeatLicenseSummary struct {
+	Id         string     `json:"id"`
+	CourseId   *string    `json:"courseId"`
+	PlanId     string     `json:"planId,omitempty"`
+	Quantity   int        `json:"quantity"`
+	Assigned   int        `json:"assigned"`
+	ValidUntil *time.Time `json:"validUntil"`
+}
+
+type OrganizationDetails struct {
+	Id       string                      `json:"id"`
+	Name     string                      `json:"name"`
+	Members  []OrganizationMemberSummary `json:"members"`
+	Licenses []SeatLicenseSummary        `json:"licenses"`
+}
+
+func CreateOrganization(name string, userID string) (*models.Organization, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	organization := models.Organization{Name: name}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.OrganizationMember{
+			OrganizationID: organization.Id,
+			UserID:         user.Id,
+			Role:           models.OrganizationRoleAdmin,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rebuildUserLeaderboards(user); err != nil {
+		log.Printf("leaderboard rebuild for %s failed: %v", userID, err)
+	}
+	return &organization, nil
+}
+
+func GetUserOrganizations(userID string) ([]models.Organization, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var organizations []models.Organization
+	err = database.DB.
+		Joins("JOIN organization_members ON organization_members.organization_id = organizations.id").
+		Where("organization_members.user_id = ?", user.Id).
+		Order("organizations.created_at").
+		Find(&organizations).Error
+	return organizations, err
+}
+
+func GetOrganizationDetails(organizationID uuid.UUID, userID string) (*OrganizationDetails, error) {
+	organization, _, err := loadOrganizationAsAdmin(organizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var licenses []models.SeatLicense
+	if err := database.DB.Where("organization_id = ?", organization.Id).Order("created_at").Find(&licenses).Error; err != nil {
+		return nil, err
+	}
+	licenseIds := make([]lib.UUID, len(licenses))
+	for i, license := range licenses {
+		licenseIds[i] = license.Id
+	}
+
+	var assignments []models.SeatAssignment
+	err = database.DB.Where("license_id IN ? AND revoked_at IS NULL", licenseIds).Find(&assignments).Error
+	if err != nil {
+		return nil, err
+	}
+	assigned := map[uuid.UUID]int{}
+	userLicenses := map[uuid.UUID][]string{}
+	for _, assignment := range assignments {
+		assigned[assignment.LicenseID.Bytes]++
+		userLicenses[assignment.UserID.Bytes] = append(userLicenses[assignment.UserID.Bytes], uuidString(assignment.LicenseID.Bytes))
+	}
+
+	var members []models.OrganizationMember
+	if err := database.DB.Where("organization_id = ?", organization.Id).Order("created_at").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	memberUserIds := make([]lib.UUID, len(members))
+	for i, member := range members {
+		memberUserIds[i] = member.UserID
+	}
+	var users []models.AppUser
+	if err := database.DB.Where("id IN ?", memberUserIds).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	clerkIds := map[uuid.UUID]string{}
+	for _, user := range users {
+		clerkIds[user.Id.Bytes] = user.ClerkId
+	}
+
+	details := &OrganizationDetails{
+		Id:       uuidString(organization.Id.Bytes),
+		Name:     organization.Name,
+		Members:  make([]OrganizationMemberSummary, len(members)),
+		Licenses: make([]SeatLicenseSummary, len(licenses)),
+	}
+	for i, member := range members {
+		details.Members[i] = OrganizationMemberSummary{
+			UserId:     clerkIds[member.UserID.Bytes],
+			Role:       member.Role,
+			LicenseIds: userLicenses[member.UserID.Bytes],
+		}
+	}
+	for i, license := range licenses {
+		details.Licenses[i] = SeatLicenseSummary{
+			Id:         uuidString(license.Id.Bytes),
+			PlanId:     license.PlanID,
+			Quantity:   license.Quantity,
+			Assigned:   assigned[license.Id.Bytes],
+			ValidUntil: license.ValidUntil,
+		}
+		if license.CourseID != nil {
+			courseId := uuidString(license.CourseID.Bytes)
+			details.Licenses[i].CourseId = &courseId
+		}
+	}
+	return details, nil
+}
+
+// loadOrganizationAsAdmin loads the organization and the user, failing
+// unless the user is one of its admins.
+func loadOrganizationAsAdmin(organizationID uuid.UUID, userID string) (*models.Organization, *models.AppUser, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var organization models.Organization
+	err = database.DB.Where("id = ?", organizationID).First(&organization).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var member models.OrganizationMember
+	err = database.DB.Where("organization_id = ? AND user_id = ?", organization.Id, user.Id).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || member.Role != models.OrganizationRoleAdmin {
+		return nil, nil, ErrNotOrganizationAdmin
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &organization, user, nil
+}
+
+// getOrCreateOrganizationStripeCustomer works like
+// GetOrCreateStripeCustomerIDForUser, for the organization's own customer.
+func getOrCreateOrganizationStripeCustomer(organization *models.Organization) (string, error) {
+	if organization.StripeId != "" {
+		return organization.StripeId, nil
+	}
+
+	organizationId := uuidString(organization.Id.Bytes)
+	params := &stripe.CustomerParams{
+		Name: stripe.String(organization.Name),
+	}
+	params.Metadata = map[string]string{
+		"organizationId": organizationId,
+	}
+	params.SetIdempotencyKey("organization-customer-create-" + organizationId)
+
+	customer, err := Payments.CreateCustomer(params)
+	if err != nil {
+		return "", err
+	}
+
+	err = database.DB.Model(&models.Organization{}).
+		Where("id = ? AND stripe_id = ''", organization.Id).
+		Update("stripe_id", customer.ID).Error
+	if err != nil {
+		return "", err
+	}
+	if err := database.DB.Where("id = ?", organization.Id).First(organization).Error; err != nil {
+		return "", err
+	}
+	return organization.StripeId, nil
+}
+
+func GenerateOrganizationCourseCheckoutLink(organizationID uuid.UUID, courseID uuid.UUID, userID string, quantity int, options CheckoutOptions) (*CheckoutLink, error) {
+	if quantity < 1 || quantity > maxSeatQuantity {
+		return nil, ErrInvalidSeatQuantity
+	}
+	organization, user, err := loadOrganizationAsAdmin(organizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	coursePtr := database.GetCourse(courseID)
+	if coursePtr == nil {
+		return nil, errors.New("course not found")
+	}
+
+	customerId, err := getOrCreateOrganizationStripeCustomer(organization)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		SuccessURL: stripe.String(frontendURL + "/organization/" + organizationID.String() + "/payment-successful"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(SelectCoursePriceId(coursePtr, ResolveBuyerLocale(user, options))),
+				Quantity: stripe.Int64(int64(quantity)),
+			},
+		},
+		Mode:     stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer: stripe.String(customerId),
+	}
+	params.Metadata = map[string]string{
+		"userId":         uuidString(user.Id.Bytes),
+		"organizationId": organizationID.String(),
+		"courseId":       courseID.String(),
+		"quantity":       strconv.Itoa(quantity),
+		"type":           "organization_course",
+	}
+	applyReferral(user, options, params.Metadata)
+
+	session, err := Payments.CreateCheckoutSession(params)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckoutLink{URL: session.URL}, nil
+}
+
+func GenerateOrganizationMembershipCheckoutLink(organizationID uuid.UUID, planID string, userID string, quantity int, options CheckoutOptions) (*CheckoutLink, error) {
+	if quantity < 1 || quantity > maxSeatQuantity {
+		return nil, ErrInvalidSeatQuantity
+	}
+	organization, user, err := loadOrganizationAsAdmin(organizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := database.GetMembershipPlan(planID)
+	if plan == nil {
+		return nil, ErrMembershipPlanNotFound
+	}
+
+	customerId, err := getOrCreateOrganizationStripeCustomer(organization)
+	if err != nil {
+		return nil, err
+	}
+
+	// The subscription carries the organization so that its invoices and
+	// updates can be told apart from personal memberships
+	params := &stripe.CheckoutSessionParams{
+		SuccessURL: stripe.String(frontendURL + "/organization/" + organizationID.String() + "/payment-successful"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(SelectMembershipPlanPriceId(plan, ResolveBuyerLocale(user, options))),
+				Quantity: stripe.Int64(int64(quantity)),
+			},
+		},
+		Mode:     stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		Customer: stripe.String(customerId),
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: map[string]string{
+				"organizationId": organizationID.String(),
+				"planId":         plan.Id,
+			},
+		},
+	}
+	params.Metadata = map[string]string{
+		"userId":         uuidString(user.Id.Bytes),
+		"organizationId": organizationID.String(),
+		"planId":         plan.Id,
+		"quantity":       strconv.Itoa(quantity),
+		"type":           "organization_membership",
+	}
+	applyReferral(user, options, params.Metadata)
+
+	session, err := Payments.CreateCheckoutSession(params)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckoutLink{URL: session.URL}, nil
+}
+
+// RecordOrganizationPurchase turns a paid organization checkout session into
+// a seat license. It is idempotent per checkout session.
+func RecordOrganizationPurchase(sessionObj *stripe.CheckoutSession, subscriptionObj *stripe.Subscription) error {
+	organizationId, err := uuid.Parse(sessionObj.Metadata["organizationId"])
+	if err != nil {
+		return err
+	}
+	quantity, err := strconv.Atoi(sessionObj.Metadata["quantity"])
+	if err != nil {
+		return err
+	}
+
+	license := models.SeatLicense{
+		OrganizationID:          lib.NewUUID(organizationId),
+		Quantity:                quantity,
+		StripeCheckoutSessionID: sessionObj.ID,
+	}
+	if subscriptionObj != nil {
+		validUntil := time.Unix(subscriptionObj.CurrentPeriodEnd, 0).UTC()
+		license.PlanID = sessionObj.Metadata["planId"]
+		license.StripeSubscriptionID = subscriptionObj.ID
+		license.ValidUntil = &validUntil
+	} else {
+		courseId, err := uuid.Parse(sessionObj.Metadata["courseId"])
+		if err != nil {
+			return err
+		}
+		courseUUID := lib.NewUUID(courseId)
+		license.CourseID = &courseUUID
+	}
+
+	return database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&license).Error
+}
+
+// IsOrganizationSubscription reports whether a subscription pays for an
+// organization's seat license rather than a personal membership, going by
+// the organization its checkout put on it.
+func IsOrganizationSubscription(subscriptionObj *stripe.Subscription) bool {
+	return subscriptionObj.Metadata["organizationId"] != ""
+}
+
+// SyncSeatLicense applies a subscription update to the membership license
+// it paid for.
+func SyncSeatLicense(subscriptionObj *stripe.Subscription) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var license models.SeatLicense
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("stripe_subscription_id = ?", subscriptionObj.ID).
+			First(&license).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The checkout.session.completed event creates the license
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		validUntil := time.Unix(subscriptionObj.CurrentPeriodEnd, 0).UTC()
+		license.ValidUntil = &validUntil
+		if subscriptionObj.Items != nil && len(subscriptionObj.Items.Data) > 0 {
+			license.Quantity = int(subscriptionObj.Items.Data[0].Quantity)
+		}
+		if err := tx.Save(&license).Error; err != nil {
+			return err
+		}
+		return revokeExcessSeats(tx, &license)
+	})
+}
+
+// revokeExcessSeats takes back the seats a license no longer has after its
+// quantity was lowered, newest assignments first. The license must be
+// locked.
+func revokeExcessSeats(tx *gorm.DB, license *models.SeatLicense) error {
+	var assigned []lib.UUID
+	err := tx.Model(&models.SeatAssignment{}).
+		Where("license_id = ? AND revoked_at IS NULL", license.Id).
+		Order("created_at DESC").
+		Pluck("id", &assigned).Error
+	if err != nil {
+		return err
+	}
+	if len(assigned) <= license.Quantity {
+		return nil
+	}
+	return tx.Model(&models.SeatAssignment{}).
+		Where("id IN ?", assigned[:len(assigned)-license.Quantity]).
+		Update("revoked_at", time.Now()).Error
+}
+
+// ExtendSeatLicense moves the end of a membership license to the end of the
+// period a paid invoice covers.
+func ExtendSeatLicense(subscriptionID string, validUntil time.Time) error {
+	return database.DB.Model(&models.SeatLicense{}).
+		Where("stripe_subscription_id = ? AND (valid_until IS NULL OR valid_until < ?)", subscriptionID, validUntil).
+		Update("valid_until", validUntil).Error
+}
+
+// EndSeatLicense ends a membership license whose subscription was deleted.
+func EndSeatLicense(subscriptionID string) error {
+	return database.DB.Model(&models.SeatLicense{}).
+		Where("stripe_subscription_id = ?", subscriptionID).
+		Update("valid_until", time.Now()).Error
+}
+
+// CreateOrganizationInvite makes an invite link. With a license, every use
+// of the invite also takes one of its seats.
+func CreateOrganizationInvite(organizationID uuid.UUID, userID string, licenseID *uuid.UUID, maxUses int) (*models.OrganizationInvite, error) {
+	organization, _, err := loadOrganizationAsAdmin(organizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := lib.RandomCode(3, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := models.OrganizationInvite{
+		OrganizationID: organization.Id,
+		Code:           code,
+		MaxUses:        maxUses,
+		ExpiresAt:      time.Now().Add(organizationInviteValidity),
+	}
+	if licenseID != nil {
+		var license models.SeatLicense
+		err := database.DB.Where("id = ? AND organization_id = ?", *licenseID, organization.Id).First(&license).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSeatLicenseNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		invite.LicenseID = &license.Id
+	}
+
+	if err := database.DB.Create(&invite).Error; err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func ClaimOrganizationInvite(code string, userID string) (*models.OrganizationInvite, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var invite models.OrganizationInvite
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&invite).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case invite.RevokedAt != nil:
+			return ErrInviteRevoked
+		case invite.ExpiresAt.Before(time.Now()):
+			return ErrInviteExpired
+		case invite.MaxUses > 0 && invite.Uses >= invite.MaxUses:
+			return ErrInviteUsedUp
+		}
+
+		member := models.OrganizationMember{
+			OrganizationID: invite.OrganizationID,
+			UserID:         user.Id,
+			Role:           models.OrganizationRoleMember,
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+			return err
+		}
+
+		if invite.LicenseID != nil {
+			if err := assignSeat(tx, *invite.LicenseID, user.Id); err != nil {
+				return err
+			}
+		}
+
+		invite.Uses++
+		return tx.Save(&invite).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the new member's scores onto the organization's leaderboards
+	if err := rebuildUserLeaderboards(user); err != nil {
+		log.Printf("leaderboard rebuild for %s failed: %v", userID, err)
+	}
+	return &invite, nil
+}
+
+func RevokeOrganizationInvite(organizationID uuid.UUID, userID string, code string) error {
+	organization, _, err := loadOrganizationAsAdmin(organizationID, userID)
+	if err != nil {
+		return err
+	}
+
+	result := database.DB.Model(&models.OrganizationInvite{}).
+		Where("organization_id = ? AND code = ? AND revoked_at IS NULL", organization.Id, code).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// ReassignSeat moves a seat of the license from one member to another. With
+// no fromUserID a free seat is assigned, with no toUserID the seat is freed.
+func ReassignSeat(organizationID uuid.UUID, licenseID uuid.UUID, adminUserID string, fromUserID string, toUserID string) error {
+	organization, _, err := loadOrganizationAsAdmin(organizationID, adminUserID)
+	if err != nil {
+		return err
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var license models.SeatLicense
+		err := tx.Where("id = ? AND organization_id = ?", licenseID, organization.Id).First(&license).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSeatLicenseNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if fromUserID != "" {
+			from, err := loadOrganizationMember(tx, organization.Id, fromUserID)
+			if err != nil {
+				return err
+			}
+			result := tx.Model(&models.SeatAssignment{}).
+				Where("license_id = ? AND user_id = ? AND revoked_at IS NULL", license.Id, from.UserID).
+				Update("revoked_at", time.Now())
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrSeatNotAssigned
+			}
+		}
+
+		if toUserID != "" {
+			to, err := loadOrganizationMember(tx, organization.Id, toUserID)
+			if err != nil {
+				return err
+			}
+			return assignSeat(tx, license.Id, to.UserID)
+		}
+		return nil
+	})
+}
+
+func loadOrganizationMember(tx *gorm.DB, organizationId lib.UUID, clerkUserId string) (*models.OrganizationMember, error) {
+	var member models.OrganizationMember
+	err := tx.Joins("JOIN app_users ON app_users.id = organization_members.user_id").
+		Where("organization_members.organization_id = ? AND app_users.clerk_id = ?", organizationId, clerkUserId).
+		First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotOrganizationMember
+	}
+	return &member, err
+}
+
+// assignSeat locks the license so that concurrent claims cannot hand out
+// more seats than were bought.
+func assignSeat(tx *gorm.DB, licenseId lib.UUID, userId lib.UUID) error {
+	var license models.SeatLicense
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", licenseId).First(&license).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrSeatLicenseNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var assignments []models.SeatAssignment
+	if err := tx.Where("license_id = ? AND revoked_at IS NULL", license.Id).Find(&assignments).Error; err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		if assignment.UserID.Bytes == userId.Bytes {
+			return ErrSeatAlreadyAssigned
+		}
+	}
+	if len(assignments) >= license.Quantity {
+		return ErrNoSeatsAvailable
+	}
+
+	return tx.Create(&models.SeatAssignment{
+		LicenseID: license.Id,
+		UserID:    userId,
+	}).Error
+}
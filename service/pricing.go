@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+)
+
+// Cached entries are dropped by the price.* and coupon.* webhooks; the TTL
+// only bounds how long a missed webhook can leave a stale value around.
+const stripeCacheTTL = 24 * time.Hour
+
+type CachedPrice struct {
+	ID         string `json:"id"`
+	Currency   string `json:"currency"`
+	UnitAmount int64  `json:"unitAmount"`
+}
+
+type CachedCoupon struct {
+	ID         string  `json:"id"`
+	PercentOff float64 `json:"percentOff"`
+	AmountOff  int64   `json:"amountOff"`
+	Currency   string  `json:"currency"`
+	Valid      bool    `json:"valid"`
+}
+
+// PriceQuote is a price in integer minor units of Currency, e.g. cents.
+type PriceQuote struct {
+	Currency       string           `json:"currency"`
+	OriginalAmount int64            `json:"originalAmount"`
+	DiscountAmount int64            `json:"discountAmount"`
+	FinalAmount    int64            `json:"finalAmount"`
+	Discount       *AppliedDiscount `json:"discount"`
+}
+
+func GetUserCoursePrice(courseID uuid.UUID, userID string, options CheckoutOptions) (*PriceQuote, error) {
+	coursePtr := database.GetCourse(courseID)
+	if coursePtr == nil {
+		return nil, errors.New("course not found")
+	}
+
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	coursePrice, err := GetCachedPrice(SelectCoursePriceId(coursePtr, ResolveBuyerLocale(user, options)))
+	if err != nil {
+		return nil, err
+	}
+
+	_, applied, err := resolveCheckoutDiscount(user, []uuid.UUID{courseID}, options.PromotionCode)
+	if err != nil {
+		return nil, err
+	}
+
+	return quotePrice(coursePrice, applied), nil
+}
+
+func quotePrice(p *CachedPrice, applied *AppliedDiscount) *PriceQuote {
+	discountAmount := calculateDiscount(p.UnitAmount, p.Currency, applied)
+	return &PriceQuote{
+		Currency:       p.Currency,
+		OriginalAmount: p.UnitAmount,
+		DiscountAmount: discountAmount,
+		FinalAmount:    p.UnitAmount - discountAmount,
+		Discount:       applied,
+	}
+}
+
+// calculateDiscount mirrors how Stripe applies a coupon to a single amount:
+// percentages are rounded to the nearest minor unit and fixed amounts only
+// apply in their own currency and never below zero.
+func calculateDiscount(amount int64, currency string, applied *AppliedDiscount) int64 {
+	if applied == nil {
+		return 0
+	}
+	if applied.PercentOff > 0 {
+		return int64(math.Round(float64(amount) * applied.PercentOff / 100))
+	}
+	if applied.AmountOff > 0 && applied.Currency == currency {
+		if applied.AmountOff > amount {
+			return amount
+		}
+		return applied.AmountOff
+	}
+	return 0
+}
+
+func GetCachedPrice(priceID string) (*CachedPrice, error) {
+	var cached CachedPrice
+	if readStripeCache(priceCacheKey(priceID), &cached) {
+		return &cached, nil
+	}
+
+	p, err := Payments.GetPrice(priceID)
+	if err != nil {
+		return nil, err
+	}
+
+	cached = CachedPrice{
+		ID:         p.ID,
+		Currency:   string(p.Currency),
+		UnitAmount: p.UnitAmount,
+	}
+	writeStripeCache(priceCacheKey(priceID), &cached)
+	return &cached, nil
+}
+
+func GetCachedCoupon(couponID string) (*CachedCoupon, error) {
+	var cached CachedCoupon
+	if readStripeCache(couponCacheKey(couponID), &cached) {
+		return &cached, nil
+	}
+
+	c, err := Payments.GetCoupon(couponID)
+	if err != nil {
+		return nil, err
+	}
+
+	cached = CachedCoupon{
+		ID:         c.ID,
+		PercentOff: c.PercentOff,
+		AmountOff:  c.AmountOff,
+		Currency:   string(c.Currency),
+		Valid:      c.Valid,
+	}
+	writeStripeCache(couponCacheKey(couponID), &cached)
+	return &cached, nil
+}
+
+func InvalidateCachedPrice(priceID string) error {
+	return invalidateStripeCache(priceCacheKey(priceID))
+}
+
+func InvalidateCachedCoupon(couponID string) error {
+	return invalidateStripeCache(couponCacheKey(couponID))
+}
+
+func priceCacheKey(priceID string) string {
+	return "stripe:price:" + priceID
+}
+
+func couponCacheKey(couponID string) string {
+	return "stripe:coupon:" + couponID
+}
+
+// readStripeCache treats any Redis failure as a cache miss so that pricing
+// keeps working, just slower, when Redis is unavailable.
+func readStripeCache(key string, value interface{}) bool {
+	data, err := database.Redis.Get(context.Background(), key).Bytes()
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, value) == nil
+}
+
+func writeStripeCache(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	database.Redis.Set(context.Background(), key, data, stripeCacheTTL)
+}
+
+func invalidateStripeCache(key string) error {
+	return database.Redis.Del(context.Background(), key).Err()
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+var ErrCourseNotFound = errors.New("course not found")
+
+// Progress rows are only ever written with single upsert statements so that
+// concurrent requests, e.g. from two open tabs, cannot overwrite each other.
+var contentProgressConflict = []clause.Column{{Name: "user_id"}, {Name: "content_id"}}
+
+func StartContent(userId uuid.UUID, contentId uuid.UUID) error {
+	progress := newContentProgress(userId, contentId, models.ContentProgressStatusStarted)
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   contentProgressConflict,
+		DoNothing: true,
+	}).Create(&progress).Error
+}
+
+func CompleteContent(userId uuid.UUID, contentId uuid.UUID) error {
+	progress := newContentProgress(userId, contentId, models.ContentProgressStatusCompleted)
+	completedAt := *progress.CompletedAt
+	completedNow := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(
+			clause.OnConflict{
+				Columns: contentProgressConflict,
+				DoUpdates: clause.Set{
+					{Column: clause.Column{Name: "status"}, Value: models.ContentProgressStatusCompleted},
+					{Column: clause.Column{Name: "completed_at"}, Value: gorm.Expr("COALESCE(content_progress.completed_at, excluded.completed_at)")},
+					{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+				},
+			},
+			clause.Returning{},
+		).Create(&progress).Error
+		if err != nil {
+			return err
+		}
+		if !newlyCompleted(progress, completedAt) {
+			return nil
+		}
+		completedNow = true
+		// Completing content again after un-completing it does not count
+		// towards the daily goal, so streaks cannot be farmed
+		if completedBefore(userId, contentId) {
+			return nil
+		}
+		return recordDailyActivity(tx, userId, 1, 0, 0)
+	})
+	if err != nil {
+		return err
+	}
+
+	if completedNow {
+		spendStreakFreezes(userId)
+		recordPuzzleSolved(userId, contentId)
+		issueCertificateIfCompleted(userId, contentId)
+	}
+	return nil
+}
+
+// recordPuzzleSolved counts newly completed puzzles on the leaderboards. A
+// puzzle solved again after a reset is not counted twice.
+func recordPuzzleSolved(userId uuid.UUID, contentId uuid.UUID) {
+	coursePtr, _, contentPtr := database.GetCourseAndChapterAndContent(contentId)
+	if contentPtr == nil || contentPtr.Type != models.ContentTypePuzzle || completedBefore(userId, contentId) {
+		return
+	}
+	courseId := uuid.UUID(coursePtr.Id.Bytes)
+	addLeaderboardScore(userId, LeaderboardPuzzlesSolved, &courseId, time.Now(), 1, false)
+}
+
+// updatePuzzleRating applies the result of a first attempt at a puzzle to
+// the user's rating. Retries, including those after a reset, do not count,
+// so a puzzle cannot be farmed.
+func updatePuzzleRating(tx *gorm.DB, userId uuid.UUID, content *models.Content, solved bool) (int, error) {
+	var user models.AppUser
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "puzzle_rating").Where("id = ?", userId).First(&user).Error
+	if err != nil {
+		return 0, err
+	}
+	rating := user.PuzzleRating + puzzleRatingChange(user.PuzzleRating, content.Rating, solved)
+	if err := tx.Model(&models.AppUser{}).Where("id = ?", userId).Update("puzzle_rating", rating).Error; err != nil {
+		return 0, err
+	}
+	return rating, nil
+}
+
+// newlyCompleted reports whether an upsert that tried to complete content at
+// completedAt was the one that completed it.
+func newlyCompleted(progress models.ContentProgress, completedAt time.Time) bool {
+	return progress.CompletedAt != nil && progress.CompletedAt.Equal(completedAt)
+}
+
+// RecordContentAttempt counts an attempt at a puzzle or quiz and keeps the
+// best score. A passing attempt also completes the content.
+func RecordContentAttempt(userId uuid.UUID, contentId uuid.UUID, score *float64, completed bool) (*models.ContentProgress, error) {
+	status := models.ContentProgressStatusStarted
+	if completed {
+		status = models.ContentProgressStatusCompleted
+	}
+	progress := newContentProgress(userId, contentId, status)
+	progress.Attempts = 1
+	progress.Score = score
+	completedAt := progress.FirstStartedAt
+	if !completed {
+		progress.CompletedAt = nil
+	}
+	_, _, contentPtr := database.GetCourseAndChapterAndContent(contentId)
+	isPuzzle := contentPtr != nil && contentPtr.Type == models.ContentTypePuzzle
+	completedNow := false
+	rating := 0
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(
+			clause.OnConflict{
+				Columns: contentProgressConflict,
+				DoUpdates: clause.Set{
+					{Column: clause.Column{Name: "attempts"}, Value: gorm.Expr("content_progress.attempts + 1")},
+					{Column: clause.Column{Name: "score"}, Value: gorm.Expr("GREATEST(content_progress.score, excluded.score)")},
+					{Column: clause.Column{Name: "status"}, Value: gorm.Expr("CASE WHEN content_progress.status = ? THEN content_progress.status ELSE excluded.status END", models.ContentProgressStatusCompleted)},
+					{Column: clause.Column{Name: "completed_at"}, Value: gorm.Expr("COALESCE(content_progress.completed_at, excluded.completed_at)")},
+					{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+				},
+			},
+			clause.Returning{},
+		).Create(&progress).Error
+		if err != nil {
+			return err
+		}
+
+		if isPuzzle && progress.Attempts == 1 {
+			attempted, err := attemptedBefore(tx, userId, contentId)
+			if err != nil {
+				return err
+			}
+			if !attempted {
+				rating, err = updatePuzzleRating(tx, userId, contentPtr, completed)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		completedContents := 0
+		if completed && newlyCompleted(progress, completedAt) {
+			completedNow = true
+			if !completedBefore(userId, contentId) {
+				completedContents = 1
+			}
+		}
+		return recordDailyActivity(tx, userId, completedContents, 1, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	spendStreakFreezes(userId)
+	if rating > 0 {
+		addLeaderboardScore(userId, LeaderboardPuzzleRating, nil, time.Now(), float64(rating), true)
+	}
+	if completedNow {
+		recordPuzzleSolved(userId, contentId)
+		issueCertificateIfCompleted(userId, contentId)
+	}
+	return &progress, nil
+}
+
+// addContentTime adds each row's TimeSpentSeconds to the user's progress on
+// the content, starting the content if needed. Rows are written in batches
+// to stay under Postgres' limit on parameters per statement.
+func addContentTime(tx *gorm.DB, rows []models.ContentProgress) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: contentProgressConflict,
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "time_spent_seconds"}, Value: gorm.Expr("content_progress.time_spent_seconds + excluded.time_spent_seconds")},
+			{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+		},
+	}).CreateInBatches(&rows, heartbeatFlushBatchSize).Error
+}
+
+func newContentProgress(userId uuid.UUID, contentId uuid.UUID, status string) models.ContentProgress {
+	// Postgres keeps microseconds, so this compares equal once read back
+	now := time.Now().Truncate(time.Microsecond)
+	progress := models.ContentProgress{
+		UserID:         lib.NewUUID(userId),
+		ContentID:      lib.NewUUID(contentId),
+		Status:         status,
+		FirstStartedAt: now,
+		UpdatedAt:      now,
+	}
+	if status == models.ContentProgressStatusCompleted {
+		progress.CompletedAt = &now
+	}
+	return progress
+}
+
+// GetCompletedContentIds returns the set of content the user has completed.
+func GetCompletedContentIds(userId uuid.UUID) (map[uuid.UUID]bool, error) {
+	var contentIds []lib.UUID
+	err := database.DB.Model(&models.ContentProgress{}).
+		Where("user_id = ? AND status = ?", userId, models.ContentProgressStatusCompleted).
+		Pluck("content_id", &contentIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	completed := make(map[uuid.UUID]bool, len(contentIds))
+	for _, contentId := range contentIds {
+		completed[contentId.Bytes] = true
+	}
+	return completed, nil
+}
+
+func IsContentCompleted(userId uuid.UUID, contentId uuid.UUID) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.ContentProgress{}).
+		Where("user_id = ? AND content_id = ? AND status = ?", userId, contentId, models.ContentProgressStatusCompleted).
+		Count(&count).Error
+	return count > 0, err
+}
+
+type ContentProgressSummary struct {
+	ContentId        string     `json:"contentId"`
+	Status           string     `json:"status"`
+	FirstStartedAt   *time.Time `json:"firstStartedAt"`
+	CompletedAt      *time.Time `json:"completedAt"`
+	Attempts         int        `json:"attempts"`
+	Score            *float64   `json:"score"`
+	TimeSpentSeconds int64      `json:"timeSpentSeconds"`
+	MinimumSeconds   int        `json:"minimumSeconds"`
+}
+
+type ChapterProgress struct {
+	ChapterId         string                   `json:"chapterId"`
+	IsSample          bool                     `json:"isSample"`
+	Completion        uint8                    `json:"completion"`
+	CompletedContents int                      `json:"completedContents"`
+	TotalContents     int                      `json:"totalContents"`
+	TimeSpentSeconds  int64                    `json:"timeSpentSeconds"`
+	Lock              *entitlement.Lock        `json:"lock"`
+	Contents          []ContentProgressSummary `json:"contents"`
+}
+
+type ResumePoint struct {
+	ChapterId string `json:"chapterId"`
+	ContentId string `json:"contentId"`
+}
+
+// CourseProgress is everything the course page needs to render a user's
+// progress in one response. Resume is nil once the course is complete. Time
+// spent trails live heartbeats by up to a minute, until they are flushed.
+type CourseProgress struct {
+	CourseId          string            `json:"courseId"`
+	Completion        uint8             `json:"completion"`
+	CompletedContents int               `json:"completedContents"`
+	TotalContents     int               `json:"totalContents"`
+	TimeSpentSeconds  int64             `json:"timeSpentSeconds"`
+	LastActivityAt    *time.Time        `json:"lastActivityAt"`
+	Resume            *ResumePoint      `json:"resume"`
+	Chapters          []ChapterProgress `json:"chapters"`
+}
+
+// GetContentProgress loads the user's progress rows for the given content,
+// keyed by content ID. Content the user never opened has no entry.
+func GetContentProgress(userId uuid.UUID, contentIds []uuid.UUID) (map[uuid.UUID]models.ContentProgress, error) {
+	var rows []models.ContentProgress
+	err := database.DB.Where("user_id = ? AND content_id IN ?", userId, contentIds).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	progress := make(map[uuid.UUID]models.ContentProgress, len(rows))
+	for _, row := range rows {
+		progress[row.ContentID.Bytes] = row
+	}
+	return progress, nil
+}
+
+func GetCourseProgress(user *models.AppUser, courseId uuid.UUID) (*CourseProgress, error) {
+	coursePtr := database.GetCourse(courseId)
+	if coursePtr == nil {
+		return nil, ErrCourseNotFound
+	}
+	userId := uuid.UUID(user.Id.Bytes)
+	locks, err := entitlement.ChapterLocks(user, coursePtr)
+	if err != nil {
+		return nil, err
+	}
+
+	contentIds := []uuid.UUID{}
+	for _, chapter := range coursePtr.Chapters {
+		for _, content := range chapter.Contents {
+			contentIds = append(contentIds, content.Id.Bytes)
+		}
+	}
+	progress, err := GetContentProgress(userId, contentIds)
+	if err != nil {
+		return nil, err
+	}
+
+	course := &CourseProgress{
+		CourseId: courseId.String(),
+		Chapters: make([]ChapterProgress, len(coursePtr.Chapters)),
+	}
+
+	// The resume point is the first unfinished content after the one the
+	// user touched last, or the first unfinished one overall, skipping
+	// locked chapters
+	var lastTouched time.Time
+	var firstUnfinished, unfinishedAfterLast *ResumePoint
+
+	for i, chapter := range coursePtr.Chapters {
+		chapterProgress := ChapterProgress{
+			ChapterId:     uuidString(chapter.Id.Bytes),
+			IsSample:      chapter.IsSample,
+			TotalContents: len(chapter.Contents),
+			Lock:          locks[i],
+			Contents:      make([]ContentProgressSummary, len(chapter.Contents)),
+		}
+
+		for j, content := range chapter.Contents {
+			summary := ContentProgressSummary{
+				ContentId:      uuidString(content.Id.Bytes),
+				MinimumSeconds: content.MinimumSeconds,
+			}
+			row, started := progress[content.Id.Bytes]
+			if started {
+				firstStartedAt := row.FirstStartedAt
+				summary.Status = row.Status
+				summary.FirstStartedAt = &firstStartedAt
+				summary.CompletedAt = row.CompletedAt
+				summary.Attempts = row.Attempts
+				summary.Score = row.Score
+				summary.TimeSpentSeconds = row.TimeSpentSeconds
+				chapterProgress.TimeSpentSeconds += row.TimeSpentSeconds
+
+				if row.UpdatedAt.After(lastTouched) {
+					lastTouched = row.UpdatedAt
+					unfinishedAfterLast = nil
+				}
+			}
+
+			if started && row.Status == models.ContentProgressStatusCompleted {
+				chapterProgress.CompletedContents++
+			} else if locks[i] == nil {
+				point := &ResumePoint{ChapterId: chapterProgress.ChapterId, ContentId: summary.ContentId}
+				if firstUnfinished == nil {
+					firstUnfinished = point
+				}
+				if unfinishedAfterLast == nil {
+					unfinishedAfterLast = point
+				}
+			}
+
+			chapterProgress.Contents[j] = summary
+		}
+
+		chapterProgress.Completion = completionPercentage(chapterProgress.CompletedContents, chapterProgress.TotalContents)
+		course.CompletedContents += chapterProgress.CompletedContents
+		course.TotalContents += chapterProgress.TotalContents
+		course.TimeSpentSeconds += chapterProgress.TimeSpentSeconds
+		course.Chapters[i] = chapterProgress
+	}
+
+	course.Completion = completionPercentage(course.CompletedContents, course.TotalContents)
+	if !lastTouched.IsZero() {
+		course.LastActivityAt = &lastTouched
+	}
+	course.Resume = unfinishedAfterLast
+	if course.Resume == nil {
+		course.Resume = firstUnfinished
+	}
+	return course, nil
+}
+
+// completionPercentage treats an empty chapter or course as complete, as the
+// homepage always has.
+func completionPercentage(completed int, total int) uint8 {
+	if total == 0 {
+		return 100
+	}
+	return uint8(completed * 100 / total)
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgtype"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	DiscountSourceMembership    = "membership"
+	DiscountSourcePromotionCode = "promotion_code"
+)
+
+var (
+	ErrInvalidPromotionCode       = errors.New("promotion code is not valid")
+	ErrPromotionCodeExpired       = errors.New("promotion code has expired")
+	ErrPromotionCodeNotApplicable = errors.New("promotion code does not apply to this checkout")
+	ErrPromotionNotCombinable     = errors.New("promotion code cannot be combined with the membership discount")
+)
+
+// AppliedDiscount describes the discount put on a checkout session.
+type AppliedDiscount struct {
+	Source     string  `json:"source"`
+	Code       string  `json:"code,omitempty"`
+	CouponId   string  `json:"couponId"`
+	PercentOff float64 `json:"percentOff,omitempty"`
+	AmountOff  int64   `json:"amountOff,omitempty"`
+	Currency   string  `json:"currency,omitempty"`
+}
+
+func IsPromotionError(err error) bool {
+	return errors.Is(err, ErrInvalidPromotionCode) ||
+		errors.Is(err, ErrPromotionCodeExpired) ||
+		errors.Is(err, ErrPromotionCodeNotApplicable) ||
+		errors.Is(err, ErrPromotionNotCombinable)
+}
+
+// resolveCheckoutDiscount picks the single discount a checkout session gets.
+// Stripe applies at most one discount per session, so a promotion code used
+// by a member is rejected unless its local rule allows it to replace the
+// member coupon.
+func resolveCheckoutDiscount(user *models.AppUser, courseIDs []uuid.UUID, promotionCode string) (*stripe.CheckoutSessionDiscountParams, *AppliedDiscount, error) {
+	var memberCoupon *CachedCoupon
+	if plan := entitlement.MembershipPlan(user); plan != nil && plan.CouponId != "" && len(courseIDs) > 0 {
+		coupon, err := GetCachedCoupon(plan.CouponId)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Stripe refuses a deleted or expired coupon, so members simply get
+		// no discount until the plan's coupon is fixed
+		if coupon.Valid {
+			memberCoupon = coupon
+		}
+	}
+
+	if promotionCode == "" {
+		if memberCoupon == nil {
+			return nil, nil, nil
+		}
+		discount := &stripe.CheckoutSessionDiscountParams{
+			Coupon: stripe.String(memberCoupon.ID),
+		}
+		applied := &AppliedDiscount{
+			Source:     DiscountSourceMembership,
+			CouponId:   memberCoupon.ID,
+			PercentOff: memberCoupon.PercentOff,
+			AmountOff:  memberCoupon.AmountOff,
+			Currency:   memberCoupon.Currency,
+		}
+		return discount, applied, nil
+	}
+
+	promo, rule, err := validatePromotionCode(user, courseIDs, promotionCode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if memberCoupon != nil && (rule == nil || !rule.ReplacesMembershipDiscount) {
+		return nil, nil, ErrPromotionNotCombinable
+	}
+
+	discount := &stripe.CheckoutSessionDiscountParams{
+		PromotionCode: stripe.String(promo.ID),
+	}
+	applied := &AppliedDiscount{
+		Source:     DiscountSourcePromotionCode,
+		Code:       promo.Code,
+		CouponId:   promo.Coupon.ID,
+		PercentOff: promo.Coupon.PercentOff,
+		AmountOff:  promo.Coupon.AmountOff,
+		Currency:   string(promo.Coupon.Currency),
+	}
+	return discount, applied, nil
+}
+
+func validatePromotionCode(user *models.AppUser, courseIDs []uuid.UUID, code string) (*stripe.PromotionCode, *models.PromotionRule, error) {
+	promo, err := Payments.FindPromotionCode(code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if promo == nil || promo.Coupon == nil || !promo.Coupon.Valid {
+		return nil, nil, ErrInvalidPromotionCode
+	}
+	if promo.ExpiresAt != 0 && time.Unix(promo.ExpiresAt, 0).Before(time.Now()) {
+		return nil, nil, ErrPromotionCodeExpired
+	}
+	if promo.Customer != nil && promo.Customer.ID != user.StripeId {
+		return nil, nil, ErrPromotionCodeNotApplicable
+	}
+
+	var rule models.PromotionRule
+	err = database.DB.Where("lower(code) = lower(?)", code).First(&rule).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return promo, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkPromotionRule(user, courseIDs, &rule); err != nil {
+		return nil, nil, err
+	}
+	return promo, &rule, nil
+}
+
+func checkPromotionRule(user *models.AppUser, courseIDs []uuid.UUID, rule *models.PromotionRule) error {
+	if rule.ExpiresAt != nil && rule.ExpiresAt.Before(time.Now()) {
+		return ErrPromotionCodeExpired
+	}
+
+	if len(rule.UserIds.Elements) > 0 && !containsUUID(rule.UserIds.Elements, user.Id.Bytes) {
+		return ErrPromotionCodeNotApplicable
+	}
+
+	if len(rule.CourseIds.Elements) > 0 {
+		// Course restricted codes never apply to membership checkouts
+		if len(courseIDs) == 0 {
+			return ErrPromotionCodeNotApplicable
+		}
+		for _, courseID := range courseIDs {
+			if !containsUUID(rule.CourseIds.Elements, courseID) {
+				return ErrPromotionCodeNotApplicable
+			}
+		}
+	}
+
+	if rule.FirstPurchaseOnly {
+		var count int64
+		if err := database.DB.Model(&models.Purchase{}).Where("user_id = ?", user.Id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrPromotionCodeNotApplicable
+		}
+	}
+
+	return nil
+}
+
+// SavePromotionRule replaces any existing rule for the same code.
+func SavePromotionRule(rule *models.PromotionRule) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("lower(code) = lower(?)", rule.Code).Delete(&models.PromotionRule{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(rule).Error
+	})
+}
+
+func containsUUID(elements []pgtype.UUID, id uuid.UUID) bool {
+	for _, element := range elements {
+		if element.Bytes == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+var ErrBundleNotFound = errors.New("bundle not found")
+
+// CheckoutCourseIds reads the courses paid for in a course, bundle or cart
+// checkout session from its metadata. The bundle ID is nil unless the
+// session sold a bundle.
+func CheckoutCourseIds(sessionObj *stripe.CheckoutSession) ([]uuid.UUID, *uuid.UUID, error) {
+	switch sessionObj.Metadata["type"] {
+	case "course":
+		courseId, err := uuid.Parse(sessionObj.Metadata["courseId"])
+		if err != nil {
+			return nil, nil, err
+		}
+		return []uuid.UUID{courseId}, nil, nil
+	case "bundle":
+		bundleId, err := uuid.Parse(sessionObj.Metadata["bundleId"])
+		if err != nil {
+			return nil, nil, err
+		}
+		bundlePtr := database.GetBundle(bundleId)
+		if bundlePtr == nil {
+			return nil, nil, ErrBundleNotFound
+		}
+		courseIds := make([]uuid.UUID, len(bundlePtr.CourseIds))
+		for i, courseId := range bundlePtr.CourseIds {
+			courseIds[i] = courseId.Bytes
+		}
+		return courseIds, &bundleId, nil
+	case "cart":
+		courseIds, err := SplitCourseIds(sessionObj.Metadata["courseIds"])
+		if err != nil {
+			return nil, nil, err
+		}
+		return courseIds, nil, nil
+	default:
+		return nil, nil, errors.New("not a course checkout")
+	}
+}
+
+// RecordCoursePurchase stores one purchase per course of a paid checkout
+// session. Courses the user already has a purchase for are skipped, so it is
+// safe to call more than once for the same session.
+func RecordCoursePurchase(user *models.AppUser, sessionObj *stripe.CheckoutSession, courseIds []uuid.UUID, bundleId *uuid.UUID) error {
+	amountTotals, amountDiscounts, err := courseAmounts(sessionObj, courseIds, bundleId)
+	if err != nil {
+		return err
+	}
+
+	purchases := make([]models.Purchase, len(courseIds))
+	for i, courseId := range courseIds {
+		purchases[i] = models.Purchase{
+			UserID:                  user.Id,
+			CourseID:                lib.NewUUID(courseId),
+			AmountTotal:             amountTotals[i],
+			AmountDiscount:          amountDiscounts[i],
+			Currency:                string(sessionObj.Currency),
+			CouponID:                sessionObj.Metadata["couponId"],
+			StripeCheckoutSessionID: sessionObj.ID,
+			Status:                  models.PurchaseStatusCompleted,
+		}
+		if bundleId != nil {
+			bundleUUID := lib.NewUUID(*bundleId)
+			purchases[i].BundleID = &bundleUUID
+		}
+		if sessionObj.PaymentIntent != nil {
+			purchases[i].StripePaymentIntentID = sessionObj.PaymentIntent.ID
+		}
+	}
+
+	// Stripe may deliver the same event more than once, and a bundle may
+	// contain a course the user already owns, so completed purchases are
+	// kept. A refunded one is bought again by this checkout.
+	return database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "course_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"bundle_id", "amount_total", "amount_discount", "currency", "coupon_id",
+			"stripe_checkout_session_id", "stripe_payment_intent_id", "status", "updated_at",
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Neq{Column: clause.Column{Table: "purchases", Name: "status"}, Value: models.PurchaseStatusCompleted},
+		}},
+	}).Create(&purchases).Error
+}
+
+// RefundPurchases marks the purchases paid for with a payment intent as
+// refunded, which takes away access to their courses.
+func RefundPurchases(paymentIntentId string) error {
+	return database.DB.Model(&models.Purchase{}).
+		Where("stripe_payment_intent_id = ? AND status = ?", paymentIntentId, models.PurchaseStatusCompleted).
+		Update("status", models.PurchaseStatusRefunded).Error
+}
+
+// courseAmounts works out what was paid for each course of a session, and
+// the discount on it. Course and cart checkouts have a line item per course,
+// in the order of courseIds. A bundle is sold at a single price, so its
+// amounts are split evenly over its courses instead.
+func courseAmounts(sessionObj *stripe.CheckoutSession, courseIds []uuid.UUID, bundleId *uuid.UUID) ([]int64, []int64, error) {
+	var amountDiscount int64
+	if sessionObj.TotalDetails != nil {
+		amountDiscount = sessionObj.TotalDetails.AmountDiscount
+	}
+	if bundleId != nil || len(courseIds) == 1 {
+		return splitAmount(sessionObj.AmountTotal, len(courseIds)), splitAmount(amountDiscount, len(courseIds)), nil
+	}
+
+	lineItems, err := Payments.ListCheckoutSessionLineItems(sessionObj.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(lineItems) != len(courseIds) {
+		return nil, nil, fmt.Errorf("checkout session %s has %d line items for %d courses", sessionObj.ID, len(lineItems), len(courseIds))
+	}
+	amountTotals := make([]int64, len(courseIds))
+	amountDiscounts := make([]int64, len(courseIds))
+	for i, lineItem := range lineItems {
+		amountTotals[i] = lineItem.AmountTotal
+		amountDiscounts[i] = lineItem.AmountDiscount
+	}
+	return amountTotals, amountDiscounts, nil
+}
+
+// splitAmount spreads a session amount over its courses, putting any
+// remainder on the first one so the parts add up to the total.
+func splitAmount(total int64, parts int) []int64 {
+	amounts := make([]int64, parts)
+	if parts == 0 {
+		return amounts
+	}
+	share := total / int64(parts)
+	for i := range amounts {
+		amounts[i] = share
+	}
+	amounts[0] += total - share*int64(parts)
+	return amounts
+}
@@ -0,0 +1,488 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// Scheduled runs only look at recent checkout sessions; older ones are left
+// to a manual run of cmd/reconcile with a longer -since.
+const reconciliationLookback = 7 * 24 * time.Hour
+
+const (
+	reconciliationLockKey = "stripe:reconciliation:lock"
+	// Longer than any run should take, so a crashed run cannot hold the
+	// lock for long
+	reconciliationLockTTL = time.Hour
+)
+
+var ErrReconciliationRunning = errors.New("another reconciliation is running")
+
+const (
+	DiscrepancyUnknownCustomer    = "unknown_customer"
+	DiscrepancyUnlinkedCustomer   = "unlinked_customer"
+	DiscrepancyDuplicateCustomer  = "duplicate_customer"
+	DiscrepancyMissingMembership  = "missing_membership"
+	DiscrepancyOutdatedMembership = "outdated_membership"
+	DiscrepancyStaleMembership    = "stale_membership"
+	DiscrepancyMissingPurchase    = "missing_purchase"
+	DiscrepancyMissingGiftCode    = "missing_gift_code"
+	DiscrepancyMissingSeatLicense = "missing_seat_license"
+	DiscrepancyInvalidCheckout    = "invalid_checkout"
+)
+
+// Discrepancy is a difference between Stripe and the database. Fixed is set
+// when the database was changed to match Stripe.
+type Discrepancy struct {
+	Kind     string `json:"kind"`
+	UserID   string `json:"userId"`
+	StripeID string `json:"stripeId"`
+	Detail   string `json:"detail"`
+	Fixed    bool   `json:"fixed"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (d Discrepancy) String() string {
+	status := "not fixed"
+	if d.Fixed {
+		status = "fixed"
+	} else if d.Error != "" {
+		status = "fix failed: " + d.Error
+	}
+	return fmt.Sprintf("%s user=%s stripe=%s %s (%s)", d.Kind, d.UserID, d.StripeID, d.Detail, status)
+}
+
+type ReconcileOptions struct {
+	// DryRun reports discrepancies without changing the database.
+	DryRun bool
+	// Since limits which checkout sessions are checked for missing
+	// purchases. Customers and subscriptions are always checked in full.
+	Since time.Time
+}
+
+type ReconciliationReport struct {
+	DryRun        bool          `json:"dryRun"`
+	StartedAt     time.Time     `json:"startedAt"`
+	FinishedAt    time.Time     `json:"finishedAt"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+func (r *ReconciliationReport) FixedCount() int {
+	fixed := 0
+	for _, d := range r.Discrepancies {
+		if d.Fixed {
+			fixed++
+		}
+	}
+	return fixed
+}
+
+// Reconcile walks Stripe customers, subscriptions and paid checkout sessions
+// and repairs local users, memberships and purchases that missed a webhook.
+// Local data is only ever brought in line with Stripe, never the other way.
+// Only one reconciliation runs at a time across instances; the others get
+// ErrReconciliationRunning.
+func Reconcile(options ReconcileOptions) (*ReconciliationReport, error) {
+	ctx := context.Background()
+
+	token := uuid.NewString()
+	acquired, err := database.Redis.SetNX(ctx, reconciliationLockKey, token, reconciliationLockTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrReconciliationRunning
+	}
+	defer func() {
+		if err := releaseLockScript.Run(ctx, database.Redis, []string{reconciliationLockKey}, token).Err(); err != nil {
+			log.Printf("releasing reconciliation lock failed: %v", err)
+		}
+	}()
+
+	report := &ReconciliationReport{
+		DryRun:        options.DryRun,
+		StartedAt:     time.Now(),
+		Discrepancies: []Discrepancy{},
+	}
+
+	if err := reconcileCustomers(report); err != nil {
+		return nil, err
+	}
+	if err := reconcileSubscriptions(report); err != nil {
+		return nil, err
+	}
+	if err := reconcileCheckoutSessions(report, options.Since); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// StartReconciliationSchedule runs Reconcile every interval in the background
+// and logs what it finds.
+func StartReconciliationSchedule(interval time.Duration, dryRun bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := Reconcile(ReconcileOptions{
+				DryRun: dryRun,
+				Since:  time.Now().Add(-reconciliationLookback),
+			})
+			if errors.Is(err, ErrReconciliationRunning) {
+				continue
+			}
+			if err != nil {
+				log.Printf("stripe reconciliation failed: %v", err)
+				continue
+			}
+			for _, d := range report.Discrepancies {
+				log.Printf("stripe reconciliation: %s", d)
+			}
+			log.Printf("stripe reconciliation: %d discrepancies, %d fixed", len(report.Discrepancies), report.FixedCount())
+		}
+	}()
+}
+
+// record adds a discrepancy to the report and, unless this is a dry run,
+// applies its fix. A nil fix means the discrepancy needs a human.
+func (r *ReconciliationReport) record(d Discrepancy, fix func() error) {
+	if !r.DryRun && fix != nil {
+		if err := fix(); err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Fixed = true
+		}
+	}
+	r.Discrepancies = append(r.Discrepancies, d)
+}
+
+func reconcileCustomers(report *ReconciliationReport) error {
+	customers, err := Payments.ListCustomers()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range customers {
+		userId, err := uuid.Parse(c.Metadata["userId"])
+		if err != nil {
+			// Not created by this application
+			continue
+		}
+
+		var user models.AppUser
+		err = database.DB.Where("id = ?", userId).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			report.record(Discrepancy{
+				Kind:     DiscrepancyUnknownCustomer,
+				UserID:   userId.String(),
+				StripeID: c.ID,
+				Detail:   "customer belongs to a user that does not exist",
+			}, nil)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case user.StripeId == "":
+			customerId := c.ID
+			report.record(Discrepancy{
+				Kind:     DiscrepancyUnlinkedCustomer,
+				UserID:   userId.String(),
+				StripeID: c.ID,
+				Detail:   "user has no Stripe customer ID",
+			}, func() error {
+				return database.DB.Model(&user).Update("stripe_id", customerId).Error
+			})
+		case user.StripeId != c.ID:
+			report.record(Discrepancy{
+				Kind:     DiscrepancyDuplicateCustomer,
+				UserID:   userId.String(),
+				StripeID: c.ID,
+				Detail:   "user is linked to customer " + user.StripeId,
+			}, nil)
+		}
+	}
+	return nil
+}
+
+func reconcileSubscriptions(report *ReconciliationReport) error {
+	subscriptions, err := Payments.ListSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	live := map[string]bool{}
+	for _, sub := range subscriptions {
+		// A failed payment leaves the membership past due until Stripe
+		// deletes the subscription, so only ended subscriptions have none
+		if !subscriptionLive(sub) && sub.Status != stripe.SubscriptionStatusPastDue && sub.Status != stripe.SubscriptionStatusUnpaid {
+			continue
+		}
+		// Organization subscriptions pay for seat licenses, not memberships
+		if sub.Metadata["organizationId"] != "" {
+			continue
+		}
+		live[sub.ID] = true
+
+		var membership models.Membership
+		err := database.DB.Where("stripe_subscription_id = ?", sub.ID).First(&membership).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := reconcileMissingMembership(report, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		expectedStatus := membershipStatus(sub.Status)
+		periodEnd := time.Unix(sub.CurrentPeriodEnd, 0).UTC()
+		if membership.Status != expectedStatus || (subscriptionLive(sub) && membership.ValidUntil.Before(periodEnd)) {
+			sub := sub
+			report.record(Discrepancy{
+				Kind:     DiscrepancyOutdatedMembership,
+				UserID:   uuidString(membership.UserID.Bytes),
+				StripeID: sub.ID,
+				Detail: fmt.Sprintf("membership is %s until %s, subscription is %s until %s",
+					membership.Status, membership.ValidUntil.Format(time.RFC3339), sub.Status, periodEnd.Format(time.RFC3339)),
+			}, func() error {
+				return SyncMembership(&membership, sub)
+			})
+		}
+	}
+
+	var memberships []models.Membership
+	if err := database.DB.Where("valid_until > ?", time.Now()).Find(&memberships).Error; err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		if live[membership.StripeSubscriptionID] {
+			continue
+		}
+		subscriptionId := membership.StripeSubscriptionID
+		report.record(Discrepancy{
+			Kind:     DiscrepancyStaleMembership,
+			UserID:   uuidString(membership.UserID.Bytes),
+			StripeID: subscriptionId,
+			Detail:   "membership is active but its subscription is not",
+		}, func() error {
+			return EndMembership(subscriptionId)
+		})
+	}
+	return nil
+}
+
+func reconcileMissingMembership(report *ReconciliationReport, sub *stripe.Subscription) error {
+	d := Discrepancy{
+		Kind:     DiscrepancyMissingMembership,
+		StripeID: sub.ID,
+		Detail:   "subscription has no membership",
+	}
+	if sub.Customer == nil {
+		report.record(d, nil)
+		return nil
+	}
+
+	var user models.AppUser
+	err := database.DB.Preload(clause.Associations).Where("stripe_id = ?", sub.Customer.ID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		d.Detail = "subscription belongs to customer " + sub.Customer.ID + " which is not linked to a user"
+		report.record(d, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	d.UserID = uuidString(user.Id.Bytes)
+	report.record(d, func() error {
+		return ActivateMembership(&user, sub, subscriptionPlanId(sub))
+	})
+	return nil
+}
+
+// subscriptionPlanId finds the membership plan a subscription is for. Only
+// plan changes store the plan on the subscription itself, so otherwise the
+// plan is matched by price.
+func subscriptionPlanId(sub *stripe.Subscription) string {
+	if planId := sub.Metadata["planId"]; planId != "" {
+		return planId
+	}
+	if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].Price != nil {
+		priceId := sub.Items.Data[0].Price.ID
+		for _, plan := range database.MembershipPlans {
+			if plan.StripePriceId == priceId {
+				return plan.Id
+			}
+			for _, planPriceId := range plan.StripePriceIds {
+				if planPriceId == priceId {
+					return plan.Id
+				}
+			}
+		}
+	}
+	return models.DefaultMembershipPlanId
+}
+
+func reconcileCheckoutSessions(report *ReconciliationReport, since time.Time) error {
+	sessions, err := Payments.ListCheckoutSessions(since)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionObj := range sessions {
+		if sessionObj.Status != stripe.CheckoutSessionStatusComplete || sessionObj.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+			continue
+		}
+
+		var err error
+		switch sessionObj.Metadata["type"] {
+		case "course", "bundle", "cart":
+			err = reconcileCoursePurchase(report, sessionObj)
+		case "gift":
+			err = reconcileGiftCode(report, sessionObj)
+		case "organization_course", "organization_membership":
+			err = reconcileSeatLicense(report, sessionObj)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcileCoursePurchase(report *ReconciliationReport, sessionObj *stripe.CheckoutSession) error {
+	d := Discrepancy{
+		Kind:     DiscrepancyInvalidCheckout,
+		UserID:   sessionObj.Metadata["userId"],
+		StripeID: sessionObj.ID,
+	}
+
+	userId, err := uuid.Parse(sessionObj.Metadata["userId"])
+	if err != nil {
+		d.Detail = "checkout session has no valid userId"
+		report.record(d, nil)
+		return nil
+	}
+	courseIds, bundleId, err := CheckoutCourseIds(sessionObj)
+	if err != nil {
+		d.Detail = err.Error()
+		report.record(d, nil)
+		return nil
+	}
+
+	var purchased int64
+	err = database.DB.Model(&models.Purchase{}).
+		Where("user_id = ? AND course_id IN ? AND status = ?", userId, courseIds, models.PurchaseStatusCompleted).
+		Count(&purchased).Error
+	if err != nil {
+		return err
+	}
+	if int(purchased) >= len(courseIds) {
+		return nil
+	}
+
+	d.Kind = DiscrepancyMissingPurchase
+	d.Detail = fmt.Sprintf("%d of %d courses have no purchase", len(courseIds)-int(purchased), len(courseIds))
+	report.record(d, func() error {
+		var user models.AppUser
+		if err := database.DB.Where("id = ?", userId).First(&user).Error; err != nil {
+			return err
+		}
+		return RecordCoursePurchase(&user, sessionObj, courseIds, bundleId)
+	})
+	return nil
+}
+
+func reconcileGiftCode(report *ReconciliationReport, sessionObj *stripe.CheckoutSession) error {
+	var count int64
+	err := database.DB.Model(&models.GiftCode{}).
+		Where("stripe_checkout_session_id = ?", sessionObj.ID).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	d := Discrepancy{
+		Kind:     DiscrepancyMissingGiftCode,
+		UserID:   sessionObj.Metadata["userId"],
+		StripeID: sessionObj.ID,
+		Detail:   "paid gift checkout has no gift code",
+	}
+	buyerId, buyerErr := uuid.Parse(sessionObj.Metadata["userId"])
+	courseId, courseErr := uuid.Parse(sessionObj.Metadata["courseId"])
+	if buyerErr != nil || courseErr != nil {
+		d.Kind = DiscrepancyInvalidCheckout
+		d.Detail = "gift checkout session has no valid userId or courseId"
+		report.record(d, nil)
+		return nil
+	}
+
+	report.record(d, func() error {
+		_, err := CreateGiftCode(buyerId, courseId, sessionObj)
+		return err
+	})
+	return nil
+}
+
+func reconcileSeatLicense(report *ReconciliationReport, sessionObj *stripe.CheckoutSession) error {
+	var count int64
+	err := database.DB.Model(&models.SeatLicense{}).
+		Where("stripe_checkout_session_id = ?", sessionObj.ID).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	d := Discrepancy{
+		Kind:     DiscrepancyMissingSeatLicense,
+		UserID:   sessionObj.Metadata["userId"],
+		StripeID: sessionObj.ID,
+		Detail:   "paid organization checkout has no seat license",
+	}
+	if _, err := uuid.Parse(sessionObj.Metadata["organizationId"]); err != nil {
+		d.Kind = DiscrepancyInvalidCheckout
+		d.Detail = "organization checkout session has no valid organizationId"
+		report.record(d, nil)
+		return nil
+	}
+	if sessionObj.Metadata["type"] == "organization_membership" && sessionObj.Subscription == nil {
+		d.Kind = DiscrepancyInvalidCheckout
+		d.Detail = "organization membership checkout session has no subscription"
+		report.record(d, nil)
+		return nil
+	}
+
+	report.record(d, func() error {
+		var subscriptionObj *stripe.Subscription
+		if sessionObj.Metadata["type"] == "organization_membership" {
+			var err error
+			subscriptionObj, err = Payments.GetSubscription(sessionObj.Subscription.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return RecordOrganizationPurchase(sessionObj, subscriptionObj)
+	})
+	return nil
+}
+
+func uuidString(bytes [16]byte) string {
+	return uuid.UUID(bytes).String()
+}
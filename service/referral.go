@@ -0,0 +1,330 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+// Users who refer a friend earn this unless their code says otherwise.
+const defaultUserReferralCommissionPercent = 10.0
+
+var (
+	ErrReferralCodeNotFound = errors.New("referral code not found")
+	ErrReferralCodeTaken    = errors.New("referral code is already in use")
+	ErrPartnerNotFound      = errors.New("partner not found")
+)
+
+type ReferralCodeReport struct {
+	Code        string           `json:"code"`
+	Clicks      int64            `json:"clicks"`
+	Signups     int64            `json:"signups"`
+	Conversions int64            `json:"conversions"`
+	Revenue     map[string]int64 `json:"revenue"`
+	Commission  map[string]int64 `json:"commission"`
+}
+
+// PartnerReport sums up a partner's codes. Revenue and commission are keyed
+// by currency, in minor units.
+type PartnerReport struct {
+	PartnerId         string               `json:"partnerId"`
+	Name              string               `json:"name"`
+	CommissionPercent float64              `json:"commissionPercent"`
+	Codes             []ReferralCodeReport `json:"codes"`
+	Revenue           map[string]int64     `json:"revenue"`
+	Commission        map[string]int64     `json:"commission"`
+}
+
+func findReferralCode(code string) (*models.ReferralCode, error) {
+	var referralCode models.ReferralCode
+	err := database.DB.Where("lower(code) = lower(?)", strings.TrimSpace(code)).First(&referralCode).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReferralCodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &referralCode, nil
+}
+
+func RecordReferralClick(code string) error {
+	referralCode, err := findReferralCode(code)
+	if err != nil {
+		return err
+	}
+	return database.DB.Create(&models.ReferralClick{ReferralCodeID: referralCode.Id}).Error
+}
+
+// GetOrCreateUserReferralCode returns the code a user shares with friends.
+func GetOrCreateUserReferralCode(userID string) (*models.ReferralCode, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var referralCode models.ReferralCode
+	err = database.DB.Where("user_id = ?", user.Id).First(&referralCode).Error
+	if err == nil {
+		return &referralCode, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	code, err := lib.RandomCode(2, 4)
+	if err != nil {
+		return nil, err
+	}
+	referralCode = models.ReferralCode{
+		Code:   code,
+		UserID: &user.Id,
+	}
+	if err := database.DB.Create(&referralCode).Error; err != nil {
+		return nil, err
+	}
+	return &referralCode, nil
+}
+
+// CreatePartner registers an affiliate. userID is the partner's own Clerk
+// user, if they have one, and lets them read their report.
+func CreatePartner(name string, userID string, commissionPercent float64) (*models.Partner, error) {
+	partner := models.Partner{
+		Name:              name,
+		CommissionPercent: commissionPercent,
+	}
+	if userID != "" {
+		user, err := entitlement.LoadUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		partner.UserID = &user.Id
+	}
+
+	if err := database.DB.Create(&partner).Error; err != nil {
+		return nil, err
+	}
+	return &partner, nil
+}
+
+// CreatePartnerReferralCode adds a code to a partner. An empty code gets a
+// random one; commissionPercent overrides the partner's rate when not nil.
+func CreatePartnerReferralCode(partnerID uuid.UUID, code string, commissionPercent *float64) (*models.ReferralCode, error) {
+	var partner models.Partner
+	err := database.DB.Where("id = ?", partnerID).First(&partner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPartnerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if code == "" {
+		code, err = lib.RandomCode(2, 4)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := findReferralCode(code); err == nil {
+		return nil, ErrReferralCodeTaken
+	} else if !errors.Is(err, ErrReferralCodeNotFound) {
+		return nil, err
+	}
+
+	referralCode := models.ReferralCode{
+		Code:              code,
+		PartnerID:         &partner.Id,
+		CommissionPercent: commissionPercent,
+	}
+	if err := database.DB.Create(&referralCode).Error; err != nil {
+		return nil, err
+	}
+	return &referralCode, nil
+}
+
+// signupReferralCodeId resolves the referral code a user signed up with.
+// Unknown codes are ignored rather than failing the signup.
+func signupReferralCodeId(code string) *lib.UUID {
+	if code == "" {
+		return nil
+	}
+	referralCode, err := findReferralCode(code)
+	if err != nil {
+		return nil
+	}
+	return &referralCode.Id
+}
+
+// applyReferral stores the referral code credited with a checkout in its
+// metadata: the one passed to the checkout, or else the one the user signed
+// up with. Users cannot refer themselves.
+func applyReferral(user *models.AppUser, options CheckoutOptions, metadata map[string]string) {
+	var referralCode *models.ReferralCode
+	if options.ReferralCode != "" {
+		referralCode, _ = findReferralCode(options.ReferralCode)
+	}
+	if referralCode == nil && user.ReferralCodeID != nil {
+		var signupCode models.ReferralCode
+		if database.DB.Where("id = ?", *user.ReferralCodeID).First(&signupCode).Error == nil {
+			referralCode = &signupCode
+		}
+	}
+
+	if referralCode == nil {
+		return
+	}
+	if self, err := selfReferral(referralCode, user.Id.Bytes); err != nil || self {
+		return
+	}
+	metadata["referralCode"] = referralCode.Code
+}
+
+// selfReferral reports whether a referral code belongs to the buyer, either
+// directly or through the partner account they run.
+func selfReferral(referralCode *models.ReferralCode, buyerId uuid.UUID) (bool, error) {
+	if referralCode.UserID != nil && referralCode.UserID.Bytes == buyerId {
+		return true, nil
+	}
+	if referralCode.PartnerID == nil {
+		return false, nil
+	}
+	var partner models.Partner
+	if err := database.DB.Where("id = ?", *referralCode.PartnerID).First(&partner).Error; err != nil {
+		return false, err
+	}
+	return partner.UserID != nil && partner.UserID.Bytes == buyerId, nil
+}
+
+// AttributeReferral records the commission for a completed checkout that
+// carries a referral code. It is idempotent per checkout session.
+func AttributeReferral(sessionObj *stripe.CheckoutSession) error {
+	code := sessionObj.Metadata["referralCode"]
+	if code == "" {
+		return nil
+	}
+	referralCode, err := findReferralCode(code)
+	if errors.Is(err, ErrReferralCodeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buyerId, err := uuid.Parse(sessionObj.Metadata["userId"])
+	if err != nil {
+		return err
+	}
+	// Checked again here in case the code changed hands after checkout
+	self, err := selfReferral(referralCode, buyerId)
+	if err != nil || self {
+		return err
+	}
+
+	commissionPercent := defaultUserReferralCommissionPercent
+	if referralCode.PartnerID != nil {
+		var partner models.Partner
+		if err := database.DB.Where("id = ?", *referralCode.PartnerID).First(&partner).Error; err != nil {
+			return err
+		}
+		commissionPercent = partner.CommissionPercent
+	}
+	if referralCode.CommissionPercent != nil {
+		commissionPercent = *referralCode.CommissionPercent
+	}
+
+	entry := models.CommissionEntry{
+		ReferralCodeID:          referralCode.Id,
+		PartnerID:               referralCode.PartnerID,
+		BuyerID:                 lib.NewUUID(buyerId),
+		CheckoutType:            sessionObj.Metadata["type"],
+		StripeCheckoutSessionID: sessionObj.ID,
+		AmountTotal:             sessionObj.AmountTotal,
+		Currency:                string(sessionObj.Currency),
+		CommissionPercent:       commissionPercent,
+		CommissionAmount:        int64(math.Round(float64(sessionObj.AmountTotal) * commissionPercent / 100)),
+	}
+	return database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error
+}
+
+func GetPartnerReport(partnerID uuid.UUID) (*PartnerReport, error) {
+	var partner models.Partner
+	err := database.DB.Where("id = ?", partnerID).First(&partner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPartnerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return partnerReport(&partner)
+}
+
+// GetPartnerReportForUser is the report of the partner the user is.
+func GetPartnerReportForUser(userID string) (*PartnerReport, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var partner models.Partner
+	err = database.DB.Where("user_id = ?", user.Id).First(&partner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPartnerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return partnerReport(&partner)
+}
+
+func partnerReport(partner *models.Partner) (*PartnerReport, error) {
+	var referralCodes []models.ReferralCode
+	if err := database.DB.Where("partner_id = ?", partner.Id).Order("created_at").Find(&referralCodes).Error; err != nil {
+		return nil, err
+	}
+
+	report := &PartnerReport{
+		PartnerId:         uuidString(partner.Id.Bytes),
+		Name:              partner.Name,
+		CommissionPercent: partner.CommissionPercent,
+		Codes:             make([]ReferralCodeReport, len(referralCodes)),
+		Revenue:           map[string]int64{},
+		Commission:        map[string]int64{},
+	}
+
+	for i, referralCode := range referralCodes {
+		codeReport := ReferralCodeReport{
+			Code:       referralCode.Code,
+			Revenue:    map[string]int64{},
+			Commission: map[string]int64{},
+		}
+		if err := database.DB.Model(&models.ReferralClick{}).Where("referral_code_id = ?", referralCode.Id).Count(&codeReport.Clicks).Error; err != nil {
+			return nil, err
+		}
+		if err := database.DB.Model(&models.AppUser{}).Where("referral_code_id = ?", referralCode.Id).Count(&codeReport.Signups).Error; err != nil {
+			return nil, err
+		}
+
+		var entries []models.CommissionEntry
+		if err := database.DB.Where("referral_code_id = ?", referralCode.Id).Find(&entries).Error; err != nil {
+			return nil, err
+		}
+		codeReport.Conversions = int64(len(entries))
+		for _, entry := range entries {
+			codeReport.Revenue[entry.Currency] += entry.AmountTotal
+			codeReport.Commission[entry.Currency] += entry.CommissionAmount
+			report.Revenue[entry.Currency] += entry.AmountTotal
+			report.Commission[entry.Currency] += entry.CommissionAmount
+		}
+
+		report.Codes[i] = codeReport
+	}
+	return report, nil
+}
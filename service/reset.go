@@ -0,0 +1,225 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	ResetResourceContent = "content"
+	ResetResourceChapter = "chapter"
+	ResetResourceCourse  = "course"
+)
+
+var (
+	ErrContentNotCompleted = errors.New("content is not completed")
+	ErrMaterialNotFound    = errors.New("material not found")
+	ErrInvalidResource     = errors.New("invalid resource")
+)
+
+// ProgressAttempt is an earlier go at a course, as archived by one reset.
+type ProgressAttempt struct {
+	ResetId    string                   `json:"resetId"`
+	Reason     string                   `json:"reason"`
+	ResetBy    string                   `json:"resetBy"`
+	Note       string                   `json:"note"`
+	ArchivedAt time.Time                `json:"archivedAt"`
+	Contents   []ContentProgressSummary `json:"contents"`
+}
+
+func archiveProgress(resetId lib.UUID, row models.ContentProgress, reason string, resetBy string, note string, now time.Time) models.ContentProgressArchive {
+	return models.ContentProgressArchive{
+		ResetID:          resetId,
+		UserID:           row.UserID,
+		ContentID:        row.ContentID,
+		Status:           row.Status,
+		FirstStartedAt:   row.FirstStartedAt,
+		CompletedAt:      row.CompletedAt,
+		TimeSpentSeconds: row.TimeSpentSeconds,
+		Attempts:         row.Attempts,
+		Score:            row.Score,
+		UpdatedAt:        row.UpdatedAt,
+		Reason:           reason,
+		ResetBy:          resetBy,
+		Note:             note,
+		ArchivedAt:       now,
+	}
+}
+
+// UncompleteContent takes back a completion, e.g. after a mis-click. The
+// content stays started and its time and attempts are kept; the completed
+// row is archived first.
+func UncompleteContent(userId uuid.UUID, contentId uuid.UUID, resetBy string, note string) error {
+	now := time.Now()
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var row models.ContentProgress
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND content_id = ?", userId, contentId).
+			First(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrContentNotCompleted
+		}
+		if err != nil {
+			return err
+		}
+		if row.Status != models.ContentProgressStatusCompleted {
+			return ErrContentNotCompleted
+		}
+
+		archive := archiveProgress(lib.NewUUID(uuid.New()), row, models.ProgressResetUncomplete, resetBy, note, now)
+		if err := tx.Create(&archive).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ContentProgress{}).Where("id = ?", row.Id).Updates(map[string]interface{}{
+			"status":       models.ContentProgressStatusStarted,
+			"completed_at": nil,
+			"updated_at":   now,
+		}).Error
+	})
+}
+
+// resetContentIds lists the content a reset of the resource covers.
+func resetContentIds(resource string, resourceId uuid.UUID) ([]uuid.UUID, error) {
+	contentIds := []uuid.UUID{}
+	switch resource {
+	case ResetResourceContent:
+		if _, _, contentPtr := database.GetCourseAndChapterAndContent(resourceId); contentPtr == nil {
+			return nil, ErrMaterialNotFound
+		}
+		contentIds = append(contentIds, resourceId)
+	case ResetResourceChapter:
+		_, chapterPtr := database.GetCourseAndChapter(resourceId)
+		if chapterPtr == nil {
+			return nil, ErrMaterialNotFound
+		}
+		for _, content := range chapterPtr.Contents {
+			contentIds = append(contentIds, content.Id.Bytes)
+		}
+	case ResetResourceCourse:
+		coursePtr := database.GetCourse(resourceId)
+		if coursePtr == nil {
+			return nil, ErrMaterialNotFound
+		}
+		for _, chapter := range coursePtr.Chapters {
+			for _, content := range chapter.Contents {
+				contentIds = append(contentIds, content.Id.Bytes)
+			}
+		}
+	default:
+		return nil, ErrInvalidResource
+	}
+	return contentIds, nil
+}
+
+// ResetProgress starts a content, chapter or course over. Progress rows are
+// moved to the archive rather than deleted. XP, achievements and
+// certificates already earned are kept, and XP is not paid again when the
+// content is completed a second time. It returns the number of rows reset.
+func ResetProgress(userId uuid.UUID, resource string, resourceId uuid.UUID, resetBy string, note string) (int, error) {
+	contentIds, err := resetContentIds(resource, resourceId)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	resetId := lib.NewUUID(uuid.New())
+	var rows []models.ContentProgress
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND content_id IN ?", userId, contentIds).
+			Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+
+		archives := make([]models.ContentProgressArchive, len(rows))
+		ids := make([]lib.UUID, len(rows))
+		for i, row := range rows {
+			archives[i] = archiveProgress(resetId, row, models.ProgressResetReset, resetBy, note, now)
+			ids[i] = row.Id
+		}
+		if err := tx.Create(&archives).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.ContentProgress{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// GetProgressHistory lists the user's archived attempts at a course, newest
+// first.
+func GetProgressHistory(userId uuid.UUID, courseId uuid.UUID) ([]ProgressAttempt, error) {
+	contentIds, err := resetContentIds(ResetResourceCourse, courseId)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []models.ContentProgressArchive
+	err = database.DB.Where("user_id = ? AND content_id IN ?", userId, contentIds).
+		Order("archived_at DESC").
+		Find(&archives).Error
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := []ProgressAttempt{}
+	index := map[[16]byte]int{}
+	for _, archive := range archives {
+		i, ok := index[archive.ResetID.Bytes]
+		if !ok {
+			i = len(attempts)
+			index[archive.ResetID.Bytes] = i
+			attempts = append(attempts, ProgressAttempt{
+				ResetId:    uuidString(archive.ResetID.Bytes),
+				Reason:     archive.Reason,
+				ResetBy:    archive.ResetBy,
+				Note:       archive.Note,
+				ArchivedAt: archive.ArchivedAt,
+				Contents:   []ContentProgressSummary{},
+			})
+		}
+
+		firstStartedAt := archive.FirstStartedAt
+		attempts[i].Contents = append(attempts[i].Contents, ContentProgressSummary{
+			ContentId:        uuidString(archive.ContentID.Bytes),
+			Status:           archive.Status,
+			FirstStartedAt:   &firstStartedAt,
+			CompletedAt:      archive.CompletedAt,
+			Attempts:         archive.Attempts,
+			Score:            archive.Score,
+			TimeSpentSeconds: archive.TimeSpentSeconds,
+		})
+	}
+	return attempts, nil
+}
+
+// completedBefore reports whether an archived attempt already completed the
+// content, so that solving it again is not counted twice.
+func completedBefore(userId uuid.UUID, contentId uuid.UUID) bool {
+	var count int64
+	err := database.DB.Model(&models.ContentProgressArchive{}).
+		Where("user_id = ? AND content_id = ? AND completed_at IS NOT NULL", userId, contentId).
+		Count(&count).Error
+	return err == nil && count > 0
+}
+
+// attemptedBefore reports whether an archived attempt already tried the
+// content, so that a reset does not make the next attempt a first one.
+func attemptedBefore(tx *gorm.DB, userId uuid.UUID, contentId uuid.UUID) (bool, error) {
+	var count int64
+	err := tx.Model(&models.ContentProgressArchive{}).
+		Where("user_id = ? AND content_id = ? AND attempts > 0", userId, contentId).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -3,37 +3,35 @@ package service
 import (
 	"errors"
 	"os"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/checkout/session"
-	"github.com/stripe/stripe-go/v74/customer"
-	"github.com/stripe/stripe-go/v74/price"
-	"github.com/stripe/stripe-go/v74/subscription"
 
 	"gorm.io/gorm/clause"
 
 	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
 	"mehmetfd.dev/chessu-backend/models"
+	"mehmetfd.dev/chessu-backend/payment"
 )
 
-const membershipDiscountAmount = 0.5
-
 var (
-	stripeSecretKey   string
-	frontendURL       string
-	membershipPriceID string
-	membershipCoupon  string
+	frontendURL string
+
+	// Payments is the payment processor every Stripe call goes through.
+	// Tests can swap in a payment.Fake.
+	Payments payment.Provider
 )
 
 func InitStripe() {
-	stripeSecretKey = os.Getenv("STRIPE_SECRET_KEY")
 	frontendURL = os.Getenv("FRONTEND_SERVER_URL")
-	membershipPriceID = os.Getenv("MEMBERSHIP_STRIPE_PRICE_ID")
-	membershipCoupon = os.Getenv("MEMBERSHIP_COUPON_ID")
-	stripe.Key = stripeSecretKey
+	Payments = payment.NewStripeProvider(os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
 }
 
+// GetOrCreateStripeCustomerIDForUser is safe to call concurrently: the
+// idempotency key makes Stripe return the same customer to every caller, and
+// the ID is only stored if the user has none yet.
 func GetOrCreateStripeCustomerIDForUser(userId uuid.UUID) (string, error) {
 	var user models.AppUser
 	if err := database.DB.Where("id = ?", userId).First(&user).Error; err != nil {
@@ -48,41 +46,70 @@ func GetOrCreateStripeCustomerIDForUser(userId uuid.UUID) (string, error) {
 	params.Metadata = map[string]string{
 		"userId": userId.String(),
 	}
+	params.SetIdempotencyKey("customer-create-" + userId.String())
 
-	customer, err := customer.New(params)
+	customer, err := Payments.CreateCustomer(params)
 	if err != nil {
 		return "", err
 	}
 
-	err = database.DB.Model(&user).Update("stripe_id", customer.ID).Error
+	err = database.DB.Model(&models.AppUser{}).
+		Where("id = ? AND stripe_id = ''", userId).
+		Update("stripe_id", customer.ID).Error
 	if err != nil {
 		return "", err
 	}
 
-	return customer.ID, nil
+	if err := database.DB.Where("id = ?", userId).First(&user).Error; err != nil {
+		return "", err
+	}
+	return user.StripeId, nil
 }
 
-func GenerateCourseCheckoutLink(courseID uuid.UUID, userID string) (string, error) {
-	var user models.AppUser
-	if err := database.DB.Where(&models.AppUser{ClerkId: userID}).First(&user).Error; err != nil {
+// ensureStripeCustomer creates the user's Stripe customer at checkout if the
+// background job has not managed to yet.
+func ensureStripeCustomer(user *models.AppUser) (string, error) {
+	if user.StripeId != "" {
+		return user.StripeId, nil
+	}
+	customerId, err := GetOrCreateStripeCustomerIDForUser(user.Id.Bytes)
+	if err != nil {
 		return "", err
 	}
+	user.StripeId = customerId
+	return customerId, nil
+}
 
-	// Check if the user is the owner of the course
-	for _, purchasedCourseID := range user.PurchasedCourseId.Elements {
-		if purchasedCourseID.Bytes == courseID {
-			return "", errors.New("user already owns this course")
-		}
+// CheckoutLink is a Stripe Checkout URL and the discount applied to it.
+type CheckoutLink struct {
+	URL      string           `json:"url"`
+	Discount *AppliedDiscount `json:"discount"`
+}
+
+func GenerateCourseCheckoutLink(courseID uuid.UUID, userID string, options CheckoutOptions) (*CheckoutLink, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
 	}
 
 	coursePtr := database.GetCourse(courseID)
 	if coursePtr == nil {
-		return "", errors.New("course not found")
+		return nil, errors.New("course not found")
+	}
+
+	// Check if the user already has access to the course
+	decision, err := entitlement.ForCourse(user, courseID)
+	if err != nil {
+		return nil, err
+	}
+	if decision.Owned() {
+		return nil, errors.New("user already owns this course")
 	}
 
+	locale := ResolveBuyerLocale(user, options)
 	lineItems := []*stripe.CheckoutSessionLineItemParams{
 		{
-			Price:    stripe.String(coursePtr.StripePriceId),
+			Price:    stripe.String(SelectCoursePriceId(coursePtr, locale)),
 			Quantity: stripe.Int64(1),
 		},
 	}
@@ -94,45 +121,67 @@ func GenerateCourseCheckoutLink(courseID uuid.UUID, userID string) (string, erro
 		"type":     "course",
 	}
 
+	successURL := frontendURL + "/course/" + courseID.String() + "/payment-successful"
+	return createCoursePaymentSession(user, []uuid.UUID{courseID}, lineItems, metadata, successURL, options)
+}
+
+// createCoursePaymentSession opens a one-off payment checkout for course line
+// items with the member coupon or the buyer's promotion code applied.
+func createCoursePaymentSession(user *models.AppUser, courseIDs []uuid.UUID, lineItems []*stripe.CheckoutSessionLineItemParams, metadata map[string]string, successURL string, options CheckoutOptions) (*CheckoutLink, error) {
+	customerId, err := ensureStripeCustomer(user)
+	if err != nil {
+		return nil, err
+	}
+
 	params := &stripe.CheckoutSessionParams{
-		SuccessURL: stripe.String(frontendURL + "/course/" + courseID.String() + "/payment-successful"),
+		SuccessURL: stripe.String(successURL),
 		LineItems:  lineItems,
 		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
-		Customer:   stripe.String(user.StripeId),
+		Customer:   stripe.String(customerId),
 	}
 
-	if user.Membership != nil {
-		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
-			{
-				Coupon: stripe.String(membershipCoupon),
-			},
+	discount, applied, err := resolveCheckoutDiscount(user, courseIDs, options.PromotionCode)
+	if err != nil {
+		return nil, err
+	}
+	if discount != nil {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{discount}
+		metadata["couponId"] = applied.CouponId
+		if applied.Code != "" {
+			metadata["promotionCode"] = applied.Code
 		}
 	}
 
+	applyReferral(user, options, metadata)
 	params.Metadata = metadata
 
-	session, err := session.New(params)
-
+	session, err := Payments.CreateCheckoutSession(params)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return session.URL, nil
+	return &CheckoutLink{URL: session.URL, Discount: applied}, nil
 }
 
-func GenerateMembershipCheckoutLink(userID string) (string, error) {
-	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).Where(&models.AppUser{ClerkId: userID}).First(&user).Error; err != nil {
-		return "", err
+func GenerateMembershipCheckoutLink(planID string, userID string, options CheckoutOptions) (*CheckoutLink, error) {
+	user, err := entitlement.LoadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entitlement.HasActiveMembership(user) {
+		return nil, errors.New("user already has a membership")
 	}
 
-	if user.Membership != nil {
-		return "", errors.New("user already has a membership")
+	plan := database.GetMembershipPlan(planID)
+	if plan == nil {
+		return nil, ErrMembershipPlanNotFound
 	}
 
+	locale := ResolveBuyerLocale(user, options)
 	lineItems := []*stripe.CheckoutSessionLineItemParams{
 		{
-			Price:    stripe.String(membershipPriceID),
+			Price:    stripe.String(SelectMembershipPlanPriceId(plan, locale)),
 			Quantity: stripe.Int64(1),
 		},
 	}
@@ -140,23 +189,78 @@ func GenerateMembershipCheckoutLink(userID string) (string, error) {
 	userIdStr, _ := uuid.FromBytes(user.Id.Bytes[:])
 	metadata := map[string]string{
 		"userId": userIdStr.String(),
+		"planId": plan.Id,
 		"type":   "membership",
 	}
 
+	customerId, err := ensureStripeCustomer(user)
+	if err != nil {
+		return nil, err
+	}
+
 	params := &stripe.CheckoutSessionParams{
 		SuccessURL: stripe.String(frontendURL + "/membership/payment-successful"),
 		LineItems:  lineItems,
 		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		Customer:   stripe.String(user.StripeId),
+		Customer:   stripe.String(customerId),
 	}
+
+	// Each user gets one trial, whichever plan it was on. It is claimed
+	// up front so concurrent checkouts cannot both start one
+	trial := false
+	if plan.TrialDays > 0 && user.TrialUsedAt == nil {
+		trial, err = claimTrial(userIdStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if trial {
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
+			TrialPeriodDays: stripe.Int64(int64(plan.TrialDays)),
+		}
+		metadata["trial"] = "true"
+	}
+
+	discount, applied, err := resolveCheckoutDiscount(user, nil, options.PromotionCode)
+	if err != nil {
+		return nil, err
+	}
+	if discount != nil {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{discount}
+		metadata["couponId"] = applied.CouponId
+		metadata["promotionCode"] = applied.Code
+	}
+
+	applyReferral(user, options, metadata)
 	params.Metadata = metadata
 
-	session, err := session.New(params)
+	session, err := Payments.CreateCheckoutSession(params)
 	if err != nil {
-		return "", err
+		if trial {
+			ReleaseTrial(userIdStr)
+		}
+		return nil, err
 	}
 
-	return session.URL, nil
+	return &CheckoutLink{URL: session.URL, Discount: applied}, nil
+}
+
+// claimTrial marks the user's trial as used, and reports whether it was
+// still available.
+func claimTrial(userId uuid.UUID) (bool, error) {
+	result := database.DB.Model(&models.AppUser{}).
+		Where("id = ? AND trial_used_at IS NULL", userId).
+		Update("trial_used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ReleaseTrial gives a trial back to a user whose trial checkout was never
+// completed.
+func ReleaseTrial(userId uuid.UUID) error {
+	return database.DB.Model(&models.AppUser{}).Where("id = ?", userId).Update("trial_used_at", nil).Error
 }
 
 func CancelMembership(userID uuid.UUID) error {
@@ -169,12 +273,12 @@ func CancelMembership(userID uuid.UUID) error {
 		return errors.New("user does not have a membership")
 	}
 
-	existingSubscription, err := subscription.Get(user.Membership.StripeSubscriptionID, nil)
+	existingSubscription, err := Payments.GetSubscription(user.Membership.StripeSubscriptionID)
 	if err != nil {
 		return err
 	}
 
-	_, err = subscription.Cancel(existingSubscription.ID, nil)
+	_, err = Payments.CancelSubscription(existingSubscription.ID)
 	if err != nil {
 		return err
 	}
@@ -192,36 +296,3 @@ func CancelMembership(userID uuid.UUID) error {
 
 	return nil
 }
-
-func GetUserCoursePrice(courseID uuid.UUID, userID string) (float64, error) {
-	price, err := getCoursePrice(courseID)
-	if err != nil {
-		return 0, err
-	}
-
-	var user models.AppUser
-	if err := database.DB.Preload(clause.Associations).Where(&models.AppUser{ClerkId: userID}).First(&user).Error; err != nil {
-		return 0, err
-	}
-
-	if user.Membership != nil {
-		price *= 1 - membershipDiscountAmount
-	}
-
-	return price, nil
-}
-
-func getCoursePrice(courseID uuid.UUID) (float64, error) {
-	coursePtr := database.GetCourse(courseID)
-
-	if coursePtr == nil {
-		return 0, errors.New("course not found")
-	}
-
-	price, err := price.Get(coursePtr.StripePriceId, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	return price.UnitAmountDecimal, nil
-}
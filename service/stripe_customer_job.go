@@ -0,0 +1,131 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/lib"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	stripeCustomerJobPollInterval = 30 * time.Second
+	stripeCustomerJobBatchSize    = 20
+	stripeCustomerJobBaseBackoff  = 30 * time.Second
+	stripeCustomerJobMaxBackoff   = 6 * time.Hour
+	// stripeCustomerJobLease keeps a claimed job from being picked up by
+	// another instance while it runs, and lets it be retried if this one
+	// dies before finishing it.
+	stripeCustomerJobLease = 5 * time.Minute
+)
+
+// wakeStripeCustomerWorker lets CreateUser start a job right away instead of
+// waiting for the next poll.
+var wakeStripeCustomerWorker = make(chan struct{}, 1)
+
+// enqueueStripeCustomerJob schedules the creation of the user's Stripe
+// customer. A user has at most one job.
+func enqueueStripeCustomerJob(tx *gorm.DB, userId lib.UUID) error {
+	job := models.StripeCustomerJob{
+		UserID:        userId,
+		NextAttemptAt: time.Now(),
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&job).Error
+}
+
+// StartStripeCustomerWorker creates pending Stripe customers in the
+// background, retrying failures with exponential backoff. Users that
+// predate the job table and still have no customer are queued first.
+func StartStripeCustomerWorker() {
+	err := database.DB.Exec(`
+		INSERT INTO stripe_customer_jobs (user_id, attempts, next_attempt_at, created_at)
+		SELECT id, 0, now(), now() FROM app_users WHERE stripe_id = ''
+		ON CONFLICT (user_id) DO NOTHING
+	`).Error
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(stripeCustomerJobPollInterval)
+		defer ticker.Stop()
+		for {
+			runStripeCustomerJobs()
+			select {
+			case <-ticker.C:
+			case <-wakeStripeCustomerWorker:
+			}
+		}
+	}()
+}
+
+func runStripeCustomerJobs() {
+	jobs, err := claimStripeCustomerJobs()
+	if err != nil {
+		log.Printf("stripe customer jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		runStripeCustomerJob(&job)
+	}
+}
+
+// claimStripeCustomerJobs takes a batch of due jobs, pushing their next
+// attempt past the lease so other instances skip them.
+func claimStripeCustomerJobs() ([]models.StripeCustomerJob, error) {
+	var jobs []models.StripeCustomerJob
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("completed_at IS NULL AND next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at").
+			Limit(stripeCustomerJobBatchSize).
+			Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+
+		ids := make([]lib.UUID, len(jobs))
+		for i, job := range jobs {
+			ids[i] = job.Id
+		}
+		return tx.Model(&models.StripeCustomerJob{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(stripeCustomerJobLease)).Error
+	})
+	return jobs, err
+}
+
+func runStripeCustomerJob(job *models.StripeCustomerJob) {
+	_, err := GetOrCreateStripeCustomerIDForUser(uuid.UUID(job.UserID.Bytes))
+	if err == nil {
+		now := time.Now()
+		job.CompletedAt = &now
+		job.LastError = ""
+	} else {
+		job.Attempts++
+		job.LastError = err.Error()
+		job.NextAttemptAt = time.Now().Add(stripeCustomerJobBackoff(job.Attempts))
+		log.Printf("stripe customer job for user %s failed (attempt %d): %v", uuidString(job.UserID.Bytes), job.Attempts, err)
+	}
+
+	if err := database.DB.Save(job).Error; err != nil {
+		log.Printf("stripe customer jobs: %v", err)
+	}
+}
+
+func stripeCustomerJobBackoff(attempts int) time.Duration {
+	backoff := stripeCustomerJobBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= stripeCustomerJobMaxBackoff {
+			return stripeCustomerJobMaxBackoff
+		}
+	}
+	return backoff
+}
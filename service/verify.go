@@ -0,0 +1,136 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"mehmetfd.dev/chessu-backend/database"
+	"mehmetfd.dev/chessu-backend/entitlement"
+	"mehmetfd.dev/chessu-backend/models"
+)
+
+const (
+	CheckCoursePurchase    = "course_purchase"
+	CheckMembership        = "membership"
+	CheckCourseCompletion  = "course_completion"
+	CheckChapterCompletion = "chapter_completion"
+	CheckContentCompletion = "content_completion"
+)
+
+const maxVerificationChecks = 200
+
+var (
+	ErrUnknownCheck      = errors.New("unknown verification check")
+	ErrTooManyChecks     = errors.New("too many verification checks")
+	ErrDuplicateCheckKey = errors.New("duplicate verification check key")
+)
+
+// VerificationCheck is one question in a batch. Key names the answer in the
+// result map and defaults to "<type>:<id>".
+type VerificationCheck struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type VerificationResult struct {
+	Verified   bool               `json:"verified"`
+	Reason     entitlement.Reason `json:"reason,omitempty"`
+	ValidUntil *time.Time         `json:"validUntil,omitempty"`
+}
+
+// VerifyBatch answers every check for an already loaded user, so a page can
+// verify everything it shows with a single user load. Malformed IDs and
+// unknown materials answer false, as the single verify routes do.
+func VerifyBatch(user *models.AppUser, checks []VerificationCheck) (map[string]VerificationResult, error) {
+	if len(checks) > maxVerificationChecks {
+		return nil, ErrTooManyChecks
+	}
+
+	results := make(map[string]VerificationResult, len(checks))
+	var completed map[uuid.UUID]bool
+
+	for _, check := range checks {
+		key := check.Key
+		if key == "" {
+			key = check.Type + ":" + check.Id
+		}
+		if _, ok := results[key]; ok {
+			return nil, ErrDuplicateCheckKey
+		}
+
+		if check.Type == CheckMembership {
+			decision, err := entitlement.ForMembership(user)
+			if err != nil {
+				return nil, err
+			}
+			results[key] = VerificationResult{Verified: decision.Allowed, Reason: decision.Reason, ValidUntil: decision.ExpiresAt}
+			continue
+		}
+
+		switch check.Type {
+		case CheckCoursePurchase, CheckCourseCompletion, CheckChapterCompletion, CheckContentCompletion:
+		default:
+			return nil, ErrUnknownCheck
+		}
+
+		id, err := uuid.Parse(check.Id)
+		if err != nil {
+			results[key] = VerificationResult{}
+			continue
+		}
+
+		if check.Type == CheckCoursePurchase {
+			decision, err := entitlement.ForCourse(user, id)
+			if err != nil {
+				results[key] = VerificationResult{}
+				continue
+			}
+			results[key] = VerificationResult{Verified: decision.Allowed, Reason: decision.Reason}
+			continue
+		}
+
+		// Completion checks share one load of the user's completed content
+		if completed == nil {
+			completed, err = GetCompletedContentIds(user.Id.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var contents []models.Content
+		switch check.Type {
+		case CheckCourseCompletion:
+			if coursePtr := database.GetCourse(id); coursePtr != nil {
+				for _, chapter := range coursePtr.Chapters {
+					contents = append(contents, chapter.Contents...)
+				}
+			} else {
+				results[key] = VerificationResult{}
+				continue
+			}
+		case CheckChapterCompletion:
+			if _, chapterPtr := database.GetCourseAndChapter(id); chapterPtr != nil {
+				contents = chapterPtr.Contents
+			} else {
+				results[key] = VerificationResult{}
+				continue
+			}
+		case CheckContentCompletion:
+			results[key] = VerificationResult{Verified: completed[id]}
+			continue
+		}
+
+		verified := true
+		for _, content := range contents {
+			if !completed[content.Id.Bytes] {
+				verified = false
+				break
+			}
+		}
+		results[key] = VerificationResult{Verified: verified}
+	}
+	return results, nil
+}